@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,6 +13,7 @@ import (
 	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
 	"github.com/JaLe29/ratelimit-simple-proxy/internal/metric"
 	"github.com/JaLe29/ratelimit-simple-proxy/internal/proxy"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/proxyproto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -48,11 +50,39 @@ func main() {
 		}
 		log.Printf("Auth domain: %s\n", config.GoogleAuth.AuthDomain)
 
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			log.Fatalf("Server error: %v", err)
+		}
+		if pp := config.Server.ProxyProtocol; pp != nil {
+			log.Printf("Accepting PROXY protocol from %v", pp.TrustedProxies)
+			listener = proxyproto.NewListener(listener, pp.Trusted, pp.Timeout)
+		}
+
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
 	}()
 
+	// Limiter counters pushed by peer replicas are received apart from the public listener
+	var clusterServer *http.Server
+	if handler := proxy.ClusterHandler(); handler != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/rlsp/system/gossip", handler)
+		clusterServer = &http.Server{
+			Addr:              config.Cluster.Listen,
+			Handler:           mux,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+
+		go func() {
+			log.Printf("Starting cluster listener on %s", clusterServer.Addr)
+			if err := clusterServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Cluster listener error: %v", err)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	// Kill will send syscall.SIGTERM signal to the process
@@ -72,7 +102,12 @@ func main() {
 		log.Printf("Error shutting down proxy: %v", err)
 	}
 
-	// Then shutdown HTTP server
+	// Then shutdown HTTP servers
+	if clusterServer != nil {
+		if err := clusterServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down cluster listener: %v", err)
+		}
+	}
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Fatal("Server forced to shutdown:", err)
 	}
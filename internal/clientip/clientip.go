@@ -0,0 +1,126 @@
+package clientip
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// RemoteAddr names the address of the connection peer among the configured sources
+const RemoteAddr = "RemoteAddr"
+
+// Unknown is returned when no client address can be determined
+const Unknown = "empty"
+
+// Resolver finds the client address of a request. Forwarding headers are only believed when the
+// connection comes from a trusted proxy and lists like X-Forwarded-For are walked from the nearest
+// hop, so clients cannot spoof their address by sending the headers themselves.
+type Resolver struct {
+	sources []string       // Headers in order of preference, RemoteAddr for the peer address
+	proxies []netip.Prefix // Proxies allowed to set the headers
+}
+
+// NewResolver creates a resolver reading the given sources when the peer is one of the trusted proxies
+func NewResolver(sources []string, trusted []netip.Prefix) *Resolver {
+	return &Resolver{sources: sources, proxies: trusted}
+}
+
+// ClientIP returns the client address of the request, falling back to the connection peer
+func (r *Resolver) ClientIP(req *http.Request) string {
+	peer, ok := ParseAddr(req.RemoteAddr)
+	if !ok {
+		return Unknown
+	}
+	if !r.Trusted(peer) {
+		return peer.String()
+	}
+
+	for _, source := range r.sources {
+		if source == RemoteAddr {
+			break
+		}
+		if addr, ok := r.fromHeader(source, req.Header.Values(source)); ok {
+			return addr.String()
+		}
+	}
+	return peer.String()
+}
+
+// Trusted reports whether the address belongs to a trusted proxy
+func (r *Resolver) Trusted(addr netip.Addr) bool {
+	for _, prefix := range r.proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromHeader returns the client address from the values of a forwarding header. Hops are walked
+// right to left and the first one that is not a trusted proxy is the client. A malformed hop makes
+// the whole header unusable, as it can no longer be told apart from a spoofed one.
+func (r *Resolver) fromHeader(name string, values []string) (netip.Addr, bool) {
+	var hops []string
+	if strings.EqualFold(name, Forwarded) {
+		nodes, ok := forwardedFor(values)
+		if !ok {
+			return netip.Addr{}, false
+		}
+		hops = nodes
+	} else {
+		for _, value := range values {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	}
+
+	var addr netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := ParseAddr(strings.TrimSpace(hops[i]))
+		if !ok {
+			return netip.Addr{}, false
+		}
+		addr = hop
+		if !r.Trusted(hop) {
+			return hop, true
+		}
+	}
+
+	// Every hop is a trusted proxy, the leftmost one sent the request
+	return addr, addr.IsValid()
+}
+
+// ParseAddr parses an IP address with an optional port, as found in RemoteAddr and forwarding headers
+func ParseAddr(s string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap().WithZone(""), true
+	}
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// ParsePrefixes parses prefixes given as CIDR ranges or single addresses, e.g. trusted proxies or blacklists
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
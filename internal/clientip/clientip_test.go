@@ -0,0 +1,69 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolver_ClientIP(t *testing.T) {
+	trusted, err := ParsePrefixes([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := NewResolver([]string{"X-Forwarded-For", "X-Real-IP", RemoteAddr}, trusted)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		want       string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.7:5000", map[string][]string{"X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.7"},
+		{"trusted peer without headers", "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"single hop", "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"1.2.3.4"}}, "1.2.3.4"},
+		{"spoofed entry left of the client", "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4"}}, "1.2.3.4"},
+		{"trusted hops are skipped", "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"1.2.3.4, 10.0.0.2", "192.168.1.1"}}, "1.2.3.4"},
+		{"all hops trusted", "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"ports are stripped", "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"1.2.3.4:8080"}}, "1.2.3.4"},
+		{"IPv6 with port", "[fd00::1]:5000", map[string][]string{"X-Forwarded-For": {"[2001:db8::1]:8080"}}, "2001:db8::1"},
+		{"IPv4 mapped IPv6 peer", "[::ffff:10.0.0.1]:5000", map[string][]string{"X-Forwarded-For": {"1.2.3.4"}}, "1.2.3.4"},
+		{"malformed hop falls through to the next header", "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"1.2.3.4, garbage"}, "X-Real-IP": {"5.6.7.8"}}, "5.6.7.8"},
+		{"malformed headers fall back to the peer", "10.0.0.1:5000", map[string][]string{"X-Forwarded-For": {"unknown"}, "X-Real-IP": {""}}, "10.0.0.1"},
+		{"unparsable peer", "pipe", nil, Unknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.headers {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+			if got := resolver.ClientIP(req); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolver_RemoteAddrSource(t *testing.T) {
+	trusted, _ := ParsePrefixes([]string{"10.0.0.0/8"})
+	resolver := NewResolver([]string{RemoteAddr, "X-Forwarded-For"}, trusted)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if got := resolver.ClientIP(req); got != "10.0.0.1" {
+		t.Errorf("Expected the peer address listed first to win, got %q", got)
+	}
+}
+
+func TestParsePrefixes_Invalid(t *testing.T) {
+	for _, value := range []string{"10.0.0.0/33", "not-an-ip", ""} {
+		if _, err := ParsePrefixes([]string{value}); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
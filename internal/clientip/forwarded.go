@@ -0,0 +1,108 @@
+package clientip
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Forwarded is the standard forwarding header of RFC 7239
+const Forwarded = "Forwarded"
+
+// forwardedFor returns the for= node of every element of Forwarded header values, nearest hop
+// last. Elements without a node, duplicate nodes and unbalanced quotes make the values malformed.
+func forwardedFor(values []string) ([]string, bool) {
+	var nodes []string
+	for _, value := range values {
+		elements, ok := splitQuoted(value, ',')
+		if !ok {
+			return nil, false
+		}
+		for _, element := range elements {
+			node := ""
+			pairs, _ := splitQuoted(element, ';')
+			for _, pair := range pairs {
+				name, v, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if !found || !strings.EqualFold(name, "for") {
+					continue
+				}
+				if node != "" {
+					return nil, false
+				}
+				node = unquote(v)
+			}
+			if node == "" {
+				return nil, false
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, true
+}
+
+// splitQuoted splits s at sep outside of quoted strings
+func splitQuoted(s string, sep byte) ([]string, bool) {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, false
+	}
+	return append(parts, s[start:]), true
+}
+
+// unquote removes the quotes and escapes of a quoted string, tokens are returned unchanged
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// FormatNode formats an address as a Forwarded node, IPv6 addresses are bracketed and quoted
+func FormatNode(addr string) string {
+	ip, err := netip.ParseAddr(addr)
+	switch {
+	case err != nil:
+		return "unknown"
+	case ip.Is6():
+		return `"[` + ip.String() + `]"`
+	default:
+		return ip.String()
+	}
+}
+
+// FormatValue quotes a Forwarded parameter value unless it is a token
+func FormatValue(v string) string {
+	if v == "" {
+		return `""`
+	}
+	for i := 0; i < len(v); i++ {
+		if !isTokenChar(v[i]) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+// isTokenChar reports whether c may appear in an HTTP token
+func isTokenChar(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
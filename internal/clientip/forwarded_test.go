@@ -0,0 +1,60 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolver_Forwarded(t *testing.T) {
+	trusted, _ := ParsePrefixes([]string{"10.0.0.0/8"})
+	resolver := NewResolver([]string{Forwarded}, trusted)
+
+	tests := []struct {
+		name   string
+		values []string
+		want   string
+	}{
+		{"single element", []string{"for=1.2.3.4;proto=https"}, "1.2.3.4"},
+		{"case insensitive parameter", []string{"For=1.2.3.4"}, "1.2.3.4"},
+		{"trusted hops are skipped", []string{"for=1.2.3.4, for=10.0.0.2", "for=10.0.0.3"}, "1.2.3.4"},
+		{"spoofed element left of the client", []string{"for=6.6.6.6, for=1.2.3.4;host=example.com"}, "1.2.3.4"},
+		{"quoted IPv6 with port", []string{`for="[2001:db8::1]:4711"`}, "2001:db8::1"},
+		{"quoted separators", []string{`for=1.2.3.4;host="a,b;c"`}, "1.2.3.4"},
+		{"obfuscated node falls back to the peer", []string{"for=_hidden"}, "10.0.0.1"},
+		{"unknown node falls back to the peer", []string{"for=unknown"}, "10.0.0.1"},
+		{"element without node falls back to the peer", []string{"for=1.2.3.4, proto=https"}, "10.0.0.1"},
+		{"duplicate node falls back to the peer", []string{"for=1.2.3.4;for=5.6.7.8"}, "10.0.0.1"},
+		{"unbalanced quote falls back to the peer", []string{`for="1.2.3.4`}, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "10.0.0.1:5000"
+			for _, value := range tt.values {
+				req.Header.Add(Forwarded, value)
+			}
+			if got := resolver.ClientIP(req); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{FormatNode("1.2.3.4"), "1.2.3.4"},
+		{FormatNode("2001:db8::1"), `"[2001:db8::1]"`},
+		{FormatNode("empty"), "unknown"},
+		{FormatValue("example.com"), "example.com"},
+		{FormatValue("example.com:8080"), `"example.com:8080"`},
+		{FormatValue(`a"b`), `"a\"b"`},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %s, want %s", tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package clientip
+
+import "net/netip"
+
+// PrefixTrie is a set of IP prefixes, e.g. a blacklist. Lookups walk at most one node per
+// address bit, so they cost the same however many prefixes the set holds.
+type PrefixTrie struct {
+	v4, v6 *trieNode
+}
+
+// trieNode is one bit of a prefix, its children continue with a 0 or 1 bit
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool // A prefix ends here and covers the whole subtree
+}
+
+// NewPrefixTrie creates a set of the given prefixes
+func NewPrefixTrie(prefixes ...netip.Prefix) *PrefixTrie {
+	t := &PrefixTrie{}
+	for _, prefix := range prefixes {
+		t.Insert(prefix)
+	}
+	return t
+}
+
+// Insert adds a prefix, IPv4-mapped IPv6 prefixes are stored as IPv4
+func (t *PrefixTrie) Insert(prefix netip.Prefix) {
+	addr, bits := prefix.Addr(), prefix.Bits()
+	if addr.Is4In6() {
+		addr, bits = addr.Unmap(), max(bits-96, 0)
+	}
+
+	root := &t.v6
+	if addr.Is4() {
+		root = &t.v4
+	}
+	if *root == nil {
+		*root = &trieNode{}
+	}
+
+	node, b := *root, addr.AsSlice()
+	for i := 0; i < bits; i++ {
+		if node.terminal {
+			return // Already covered by a shorter prefix
+		}
+		bit := b[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.terminal = true
+	node.children = [2]*trieNode{} // Longer prefixes below are covered now
+}
+
+// Contains reports whether the address falls into any prefix of the set, a nil set is empty
+func (t *PrefixTrie) Contains(addr netip.Addr) bool {
+	if t == nil || !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+
+	node := t.v6
+	if addr.Is4() {
+		node = t.v4
+	}
+	b := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == len(b)*8 {
+			return false
+		}
+		node = node.children[b[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
+
+// ContainsString parses the address, as returned by Resolver.ClientIP, and reports whether it is in the set
+func (t *PrefixTrie) ContainsString(ip string) bool {
+	addr, ok := ParseAddr(ip)
+	return ok && t.Contains(addr)
+}
+
+// Aggregate shortens an IPv6 address to a prefix of the given length, e.g. a /64 shared by all
+// addresses of one client network. IPv4 addresses and unparsable values are returned unchanged.
+func Aggregate(ip string, bits int) string {
+	addr, ok := ParseAddr(ip)
+	if !ok || !addr.Is6() || bits <= 0 || bits >= 128 {
+		return ip
+	}
+	return netip.PrefixFrom(addr, bits).Masked().String()
+}
@@ -0,0 +1,79 @@
+package clientip
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	prefixes, err := ParsePrefixes([]string{"203.0.113.0/24", "198.51.100.7", "2001:db8:1::/48", "10.0.0.0/8", "10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trie := NewPrefixTrie(prefixes...)
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"203.0.113.1", true},
+		{"203.0.113.255", true},
+		{"203.0.114.1", false},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"10.1.2.3", true},
+		{"10.200.0.1", true},
+		{"::ffff:203.0.113.9", true},
+		{"2001:db8:1:ffff::1", true},
+		{"2001:db8:2::1", false},
+		{"2001:db8:1::", true},
+		{"empty", false},
+	}
+
+	for _, tt := range tests {
+		if got := trie.ContainsString(tt.ip); got != tt.want {
+			t.Errorf("ContainsString(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	var empty *PrefixTrie
+	if empty.Contains(netip.MustParseAddr("203.0.113.1")) {
+		t.Error("Nil trie should be empty")
+	}
+	if NewPrefixTrie(netip.MustParsePrefix("0.0.0.0/0")).ContainsString("2001:db8::1") {
+		t.Error("IPv4 prefixes must not match IPv6 addresses")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		ip   string
+		bits int
+		want string
+	}{
+		{"2001:db8:1:2:3:4:5:6", 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:3:4:5:6", 48, "2001:db8:1::/48"},
+		{"2001:db8:1:2:3:4:5:6", 0, "2001:db8:1:2:3:4:5:6"},
+		{"203.0.113.1", 64, "203.0.113.1"},
+		{"empty", 64, "empty"},
+	}
+	for _, tt := range tests {
+		if got := Aggregate(tt.ip, tt.bits); got != tt.want {
+			t.Errorf("Aggregate(%q, %d) = %q, want %q", tt.ip, tt.bits, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkPrefixTrie_Contains(b *testing.B) {
+	trie := NewPrefixTrie()
+	for i := 0; i < 100000; i++ {
+		trie.Insert(netip.MustParsePrefix(fmt.Sprintf("%d.%d.%d.0/24", 1+i>>16, i>>8&0xFF, i&0xFF)))
+	}
+	addr := netip.MustParseAddr("203.0.113.1")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Contains(addr)
+	}
+}
@@ -1,12 +1,17 @@
 package config
 
 import (
+	"bytes"
+	"encoding/csv"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/clientip"
 	"gopkg.in/yaml.v3"
 )
 
@@ -15,7 +20,10 @@ func LoadConfig(configPath string) (*Config, error) {
 	// Default configuration
 	config := &config{
 		IPHeader: IPHeaderConfig{
-			Headers: []string{"X-Forwarded-For", "X-Real-IP"},
+			Headers: []string{"X-Forwarded-For", "X-Real-IP", "Forwarded"},
+			// Only local proxies are believed by default, any client of a private network
+			// could spoof its address otherwise. Load balancers have to be listed explicitly.
+			TrustedProxies: []string{"127.0.0.0/8", "::1/128"},
 		},
 		RateLimits:  make(map[string]rateLimitConfig),
 		IPBlackList: []string{},
@@ -62,6 +70,124 @@ func LoadConfig(configPath string) (*Config, error) {
 	if len(config.IPHeader.Headers) == 0 {
 		return nil, fmt.Errorf("no IP header defined")
 	}
+	trusted, err := clientip.ParsePrefixes(config.IPHeader.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	config.IPHeader.Trusted = trusted
+
+	// Blacklist entries are single IPs or CIDR ranges
+	globalBlackList, err := clientip.ParsePrefixes(config.IPBlackList)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ipBlackList entry: %w", err)
+	}
+	globalAllowList, err := clientip.ParsePrefixes(config.IPAllowList)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ipAllowList entry: %w", err)
+	}
+	switch config.IPAllowListMode {
+	case "":
+		config.IPAllowListMode = AllowListExempt
+	case AllowListExempt, AllowListRestrict:
+	default:
+		return nil, fmt.Errorf("unknown ipAllowListMode: %s", config.IPAllowListMode)
+	}
+	if config.IPv6KeyPrefix < 0 || config.IPv6KeyPrefix > 128 {
+		return nil, fmt.Errorf("ipv6KeyPrefix must be between 0 and 128")
+	}
+
+	// Validate PROXY protocol, headers are only accepted from known load balancers
+	if pp := config.Server.ProxyProtocol; pp != nil {
+		if len(pp.TrustedProxies) == 0 {
+			return nil, fmt.Errorf("proxy protocol is enabled but no trusted proxies are configured")
+		}
+		if pp.Trusted, err = clientip.ParsePrefixes(pp.TrustedProxies); err != nil {
+			return nil, fmt.Errorf("invalid proxy protocol trusted proxy: %w", err)
+		}
+	}
+
+	// Validate Redis backend
+	if config.Redis != nil {
+		if config.Redis.Address == "" {
+			return nil, fmt.Errorf("redis is configured but address is missing")
+		}
+		if config.Redis.FailurePolicy != FailOpen && config.Redis.FailurePolicy != FailClosed {
+			return nil, fmt.Errorf("redis has unknown failurePolicy: %s", config.Redis.FailurePolicy)
+		}
+	}
+
+	// Validate cluster
+	if config.Cluster != nil {
+		if config.Cluster.NodeID == "" {
+			return nil, fmt.Errorf("cluster is configured but nodeId is missing")
+		}
+		// Anyone reaching the cluster listener could push counters without a secret
+		if config.Cluster.Secret == "" {
+			return nil, fmt.Errorf("cluster is configured but secret is missing")
+		}
+		for _, peer := range config.Cluster.Peers {
+			if !strings.HasPrefix(peer, "http://") && !strings.HasPrefix(peer, "https://") {
+				return nil, fmt.Errorf("cluster peer '%s' must be an http(s) URL", peer)
+			}
+		}
+	}
+
+	// Validate persistence
+	if config.Persistence != nil {
+		if config.Persistence.Dir == "" {
+			return nil, fmt.Errorf("persistence is configured but dir is missing")
+		}
+		if config.Persistence.Interval < 0 {
+			return nil, fmt.Errorf("persistence interval must not be negative")
+		}
+	}
+
+	// Validate tiers
+	for name, tier := range config.Tiers {
+		if err := config.validateLimit("tier "+name, &tier.LimitConfig); err != nil {
+			return nil, err
+		}
+		if err := validateRequests("tier "+name, &tier.LimitConfig); err != nil {
+			return nil, err
+		}
+		for i := range tier.Limits {
+			limitName := fmt.Sprintf("tier %s limit %d", name, i+1)
+			if err := config.validateLimit(limitName, &tier.Limits[i]); err != nil {
+				return nil, err
+			}
+			if err := validateRequests(limitName, &tier.Limits[i]); err != nil {
+				return nil, err
+			}
+		}
+		if tier.MaxWait > 0 {
+			return nil, fmt.Errorf("rate limit 'tier %s': maxWait is not supported on tiers", name)
+		}
+		config.Tiers[name] = tier
+	}
+
+	// Validate API keys
+	if config.APIKeys != nil {
+		if config.APIKeys.File != "" {
+			keys, err := loadAPIKeys(config.APIKeys.File)
+			if err != nil {
+				return nil, fmt.Errorf("error loading API keys: %w", err)
+			}
+			// Inline keys take precedence over the file
+			for key, tier := range config.APIKeys.Keys {
+				keys[key] = tier
+			}
+			config.APIKeys.Keys = keys
+		}
+		if _, ok := config.Tiers[config.APIKeys.AnonymousTier]; !ok {
+			return nil, fmt.Errorf("apiKeys anonymous tier '%s' is not defined in tiers", config.APIKeys.AnonymousTier)
+		}
+		// The keys are secrets, so errors name only the tier
+		for _, tier := range config.APIKeys.Keys {
+			if _, ok := config.Tiers[tier]; !ok {
+				return nil, fmt.Errorf("an API key maps to undefined tier '%s'", tier)
+			}
+		}
+	}
 
 	// Validate Google Auth
 	if config.GoogleAuth != nil && config.GoogleAuth.Enabled {
@@ -80,17 +206,91 @@ func LoadConfig(configPath string) (*Config, error) {
 		if rl.Destination == "" {
 			return nil, fmt.Errorf("rate limit '%s' is missing destination", key)
 		}
-		if rl.Requests < -1 {
-			return nil, fmt.Errorf("rate limit '%s' has invalid number of requests: %d", key, rl.Requests)
+		if err := config.validateLimit(key, &rl.LimitConfig); err != nil {
+			return nil, err
+		}
+
+		if rl.Tiered {
+			if config.APIKeys == nil {
+				return nil, fmt.Errorf("rate limit '%s' is tiered but apiKeys are not configured", key)
+			}
+			if rl.Requests != 0 || rl.PerSecond != 0 {
+				return nil, fmt.Errorf("rate limit '%s' is tiered, requests and perSecond come from the tiers", key)
+			}
+		} else if err := validateRequests(key, &rl.LimitConfig); err != nil {
+			return nil, err
+		}
+
+		for i := range rl.Limits {
+			name := fmt.Sprintf("%s limit %d", key, i+1)
+			if err := config.validateLimit(name, &rl.Limits[i]); err != nil {
+				return nil, err
+			}
+			if err := validateRequests(name, &rl.Limits[i]); err != nil {
+				return nil, err
+			}
+			if rl.Limits[i].MaxWait > 0 {
+				return nil, fmt.Errorf("rate limit '%s': maxWait is only supported on the host limit", name)
+			}
+		}
+
+		if rl.Shadow != nil {
+			if rl.Shadow.Mode == "" {
+				rl.Shadow.Mode = ModeShadow
+			}
+			if rl.Shadow.Mode != ModeShadow {
+				return nil, fmt.Errorf("rate limit '%s' shadow limit must use mode %s", key, ModeShadow)
+			}
+			if err := config.validateLimit(key+" shadow", rl.Shadow); err != nil {
+				return nil, err
+			}
+		}
+
+		for i := range rl.Rules {
+			if err := config.validateRule(key, i, &rl.Rules[i]); err != nil {
+				return nil, err
+			}
+		}
+
+		switch rl.ForwardedHeaders {
+		case "":
+			rl.ForwardedHeaders = ForwardedLegacy
+		case ForwardedLegacy, ForwardedRFC7239, ForwardedBoth:
+		default:
+			return nil, fmt.Errorf("rate limit '%s' has unknown forwardedHeaders: %s", key, rl.ForwardedHeaders)
+		}
+
+		switch rl.IPAllowListMode {
+		case "":
+			rl.IPAllowListMode = config.IPAllowListMode
+		case AllowListExempt, AllowListRestrict:
+		default:
+			return nil, fmt.Errorf("rate limit '%s' has unknown ipAllowListMode: %s", key, rl.IPAllowListMode)
+		}
+		if rl.IPAllowListMode == AllowListRestrict && len(rl.IPAllowList)+len(config.IPAllowList) == 0 {
+			return nil, fmt.Errorf("rate limit '%s' is restricted to the ipAllowList but the list is empty", key)
 		}
-		if rl.PerSecond < -1 {
-			return nil, fmt.Errorf("rate limit '%s' has invalid perSecond value: %d", key, rl.PerSecond)
+
+		if rl.Adaptive != nil {
+			if err := validateAdaptive(key, rl.Adaptive); err != nil {
+				return nil, err
+			}
 		}
 
-		if rl.Requests == -1 && rl.PerSecond != -1 || rl.Requests != -1 && rl.PerSecond == -1 {
-			return nil, fmt.Errorf("rate limit '%s' has invalid requests and perSecond values: %d, %d", key, rl.Requests, rl.PerSecond)
+		if rl.Concurrency != nil && (rl.Concurrency.PerKey < 0 || rl.Concurrency.Total < 0) {
+			return nil, fmt.Errorf("rate limit '%s' has invalid concurrency values: %d, %d", key, rl.Concurrency.PerKey, rl.Concurrency.Total)
 		}
 
+		if rl.Bandwidth != nil {
+			if err := validateByteRate(key+" bandwidth perKey", rl.Bandwidth.PerKey); err != nil {
+				return nil, err
+			}
+			if err := validateByteRate(key+" bandwidth host", rl.Bandwidth.Host); err != nil {
+				return nil, err
+			}
+		}
+		config.RateLimits[key] = rl
+
 		// Validate allowedEmails for Google Auth
 		if config.GoogleAuth != nil && config.GoogleAuth.Enabled && len(rl.AllowedEmails) > 0 {
 			if len(rl.AllowedEmails) == 0 {
@@ -102,34 +302,131 @@ func LoadConfig(configPath string) (*Config, error) {
 	// Debug output
 	fmt.Println("Loaded rate limits:")
 	for k, rl := range config.RateLimits {
-		fmt.Printf("Key: %s, Destination: %s, Requests: %d, PerSecond: %d\n",
-			k, rl.Destination, rl.Requests, rl.PerSecond)
+		fmt.Printf("Key: %s, Destination: %s, Algorithm: %s, Backend: %s, Requests: %d, PerSecond: %d\n",
+			k, rl.Destination, rl.Algorithm, rl.Backend, rl.Requests, rl.PerSecond)
+		if rl.MaxKeys > 0 {
+			fmt.Printf("  MaxKeys: %d\n", rl.MaxKeys)
+		}
+		if rl.MaxWait > 0 {
+			fmt.Printf("  MaxWait: %v, QueueSize: %d\n", rl.MaxWait, rl.QueueSize)
+		}
+		if rl.Algorithm == AlgorithmTokenBucket {
+			fmt.Printf("  Burst: %d, RefillRate: %g/s\n", rl.Burst, rl.RefillRate)
+		}
+		if rl.Mode == ModeShadow {
+			fmt.Println("  Mode: shadow")
+		}
+		if rl.Key != "" {
+			fmt.Printf("  Key: %s\n", rl.Key)
+		}
+		if rl.Shadow != nil {
+			fmt.Printf("  Shadow: Algorithm: %s, Requests: %d, PerSecond: %d\n",
+				rl.Shadow.Algorithm, rl.Shadow.Requests, rl.Shadow.PerSecond)
+		}
+		if rl.Tiered {
+			fmt.Println("  Tiered: limits by API key tier")
+		}
+		if rl.CostHeader != "" {
+			fmt.Printf("  Cost header: %s\n", rl.CostHeader)
+		}
+		if rl.ForwardedHeaders != ForwardedLegacy {
+			fmt.Printf("  Forwarded headers: %s\n", rl.ForwardedHeaders)
+		}
+		if len(rl.IPAllowList) > 0 || rl.IPAllowListMode == AllowListRestrict {
+			fmt.Printf("  IP allowlist (%s): %v\n", rl.IPAllowListMode, rl.IPAllowList)
+		}
+		if a := rl.Adaptive; a != nil {
+			fmt.Printf("  Adaptive: Requests: %d-%d, PerSecond: %d, Latency: %v, ErrorRate: %g, Interval: %v\n",
+				a.MinRequests, a.MaxRequests, a.PerSecond, a.Latency, a.ErrorRate, a.Interval)
+		}
+		for i, limit := range rl.Limits {
+			fmt.Printf("  Limit %d: Algorithm: %s, Requests: %d, PerSecond: %d, Period: %s\n",
+				i+1, limit.Algorithm, limit.Requests, limit.PerSecond, limit.Period)
+		}
+		if rl.Concurrency != nil {
+			fmt.Printf("  Concurrency: PerKey: %d, Total: %d\n", rl.Concurrency.PerKey, rl.Concurrency.Total)
+		}
+		if rl.Bandwidth != nil {
+			if rl.Bandwidth.PerKey != nil {
+				fmt.Printf("  Bandwidth per key: %d B/s, burst %d B\n", rl.Bandwidth.PerKey.Rate, rl.Bandwidth.PerKey.Burst)
+			}
+			if rl.Bandwidth.Host != nil {
+				fmt.Printf("  Bandwidth host: %d B/s, burst %d B\n", rl.Bandwidth.Host.Rate, rl.Bandwidth.Host.Burst)
+			}
+		}
+		for _, rule := range rl.Rules {
+			fmt.Printf("  Rule %s: Methods: %v, PathPrefix: %q, PathRegex: %q, Key: %q, Algorithm: %s, Requests: %d, PerSecond: %d, Cost: %d\n",
+				rule.Name, rule.Methods, rule.PathPrefix, rule.PathRegex, rule.Key, rule.Algorithm, rule.Requests, rule.PerSecond, rule.Cost)
+		}
 		if len(rl.AllowedEmails) > 0 {
 			fmt.Printf("  Allowed Emails: %v\n", rl.AllowedEmails)
 		}
 	}
 
+	fmt.Printf("Client IP sources: %v, trusted proxies: %v\n", config.IPHeader.Headers, config.IPHeader.TrustedProxies)
+	if len(config.IPAllowList) > 0 {
+		fmt.Printf("Global IP allowlist: %v\n", config.IPAllowList)
+	}
+	if config.IPv6KeyPrefix > 0 {
+		fmt.Printf("IPv6 limiter keys aggregated to /%d\n", config.IPv6KeyPrefix)
+	}
+
+	for name, tier := range config.Tiers {
+		fmt.Printf("Tier: %s, Algorithm: %s, Requests: %d, PerSecond: %d, Limits: %d\n",
+			name, tier.Algorithm, tier.Requests, tier.PerSecond, len(tier.Limits))
+	}
+	if config.APIKeys != nil {
+		fmt.Printf("API keys: %d from header %s, anonymous tier: %s\n",
+			len(config.APIKeys.Keys), config.APIKeys.Header, config.APIKeys.AnonymousTier)
+	}
+
 	// Create global config with better structure
 	globalConfig := &Config{
-		IPHeader:   config.IPHeader,
-		GoogleAuth: config.GoogleAuth,
-		RateLimits: make(map[string]RateLimitConfig),
-		Server:     config.Server,
-		Transport:  config.Transport,
+		IPHeader:      config.IPHeader,
+		GoogleAuth:    config.GoogleAuth,
+		RateLimits:    make(map[string]RateLimitConfig),
+		IPv6KeyPrefix: config.IPv6KeyPrefix,
+		Server:        config.Server,
+		Transport:     config.Transport,
+		Redis:         config.Redis,
+		Cluster:       config.Cluster,
+		Persistence:   config.Persistence,
+		Tiers:         config.Tiers,
+		APIKeys:       config.APIKeys,
 	}
 
 	for key, value := range config.RateLimits {
-		rateLimitConfig := RateLimitConfig{
-			Destination:   value.Destination,
-			Requests:      value.Requests,
-			PerSecond:     value.PerSecond,
-			IPBlackList:   make(map[string]bool),
-			AllowedEmails: value.AllowedEmails,
-			Auth:          value.Auth,
+		hostBlackList, err := clientip.ParsePrefixes(value.IPBlackList)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit '%s' has invalid ipBlackList entry: %w", key, err)
 		}
+		// The global lists apply to every host
+		blackList := clientip.NewPrefixTrie(append(hostBlackList, globalBlackList...)...)
+		hostAllowList, err := clientip.ParsePrefixes(value.IPAllowList)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit '%s' has invalid ipAllowList entry: %w", key, err)
+		}
+		allowList := clientip.NewPrefixTrie(append(hostAllowList, globalAllowList...)...)
 
-		for _, ip := range value.IPBlackList {
-			rateLimitConfig.IPBlackList[ip] = true
+		rateLimitConfig := RateLimitConfig{
+			LimitConfig:      value.LimitConfig,
+			Destination:      value.Destination,
+			IPBlackList:      blackList,
+			IPAllowList:      allowList,
+			IPAllowListMode:  value.IPAllowListMode,
+			AllowedEmails:    value.AllowedEmails,
+			Auth:             value.Auth,
+			Headers:          value.Headers,
+			Shadow:           value.Shadow,
+			Rules:            value.Rules,
+			Key:              value.Key,
+			Concurrency:      value.Concurrency,
+			Bandwidth:        value.Bandwidth,
+			Limits:           value.Limits,
+			Tiered:           value.Tiered,
+			CostHeader:       value.CostHeader,
+			Adaptive:         value.Adaptive,
+			ForwardedHeaders: value.ForwardedHeaders,
 		}
 
 		// Add the original domain
@@ -151,16 +448,24 @@ func LoadConfig(configPath string) (*Config, error) {
 				if alternativeDomain != "" && alternativeDomain != key {
 					// Create a copy of the rate limit config for the alternative domain
 					alternativeConfig := RateLimitConfig{
-						Destination:   value.Destination,
-						Requests:      value.Requests,
-						PerSecond:     value.PerSecond,
-						IPBlackList:   make(map[string]bool),
-						AllowedEmails: value.AllowedEmails,
-						Auth:          value.Auth,
-					}
-
-					for _, ip := range value.IPBlackList {
-						alternativeConfig.IPBlackList[ip] = true
+						LimitConfig:      value.LimitConfig,
+						Destination:      value.Destination,
+						IPBlackList:      blackList,
+						IPAllowList:      allowList,
+						IPAllowListMode:  value.IPAllowListMode,
+						AllowedEmails:    value.AllowedEmails,
+						Auth:             value.Auth,
+						Headers:          value.Headers,
+						Shadow:           value.Shadow,
+						Rules:            value.Rules,
+						Key:              value.Key,
+						Concurrency:      value.Concurrency,
+						Bandwidth:        value.Bandwidth,
+						Limits:           value.Limits,
+						Tiered:           value.Tiered,
+						CostHeader:       value.CostHeader,
+						Adaptive:         value.Adaptive,
+						ForwardedHeaders: value.ForwardedHeaders,
 					}
 
 					globalConfig.RateLimits[alternativeDomain] = alternativeConfig
@@ -170,15 +475,273 @@ func LoadConfig(configPath string) (*Config, error) {
 		*/
 	}
 
-	// Copy global blacklist to all rate limits
-	for key, value := range globalConfig.RateLimits {
-		for _, valueBl := range config.IPBlackList {
-			value.IPBlackList[valueBl] = true
+	return globalConfig, nil
+}
+
+// validateRule validates a per-path rule of a host and compiles its path regex
+func (c *config) validateRule(host string, index int, rule *RuleConfig) error {
+	if rule.Name == "" {
+		rule.Name = fmt.Sprintf("rule-%d", index+1)
+	}
+	name := host + " rule " + rule.Name
+
+	if rule.PathRegex != "" {
+		re, err := regexp.Compile(rule.PathRegex)
+		if err != nil {
+			return fmt.Errorf("rate limit '%s' has invalid pathRegex: %w", name, err)
 		}
-		globalConfig.RateLimits[key] = value
+		rule.Regexp = re
 	}
 
-	return globalConfig, nil
+	for i, method := range rule.Methods {
+		rule.Methods[i] = strings.ToUpper(method)
+	}
+
+	if err := c.validateLimit(name, &rule.LimitConfig); err != nil {
+		return err
+	}
+
+	if err := validateRequests(name, &rule.LimitConfig); err != nil {
+		return err
+	}
+
+	if rule.Cost < 0 {
+		return fmt.Errorf("rate limit '%s' has invalid cost: %d", name, rule.Cost)
+	}
+	if rule.Cost == 0 {
+		rule.Cost = 1
+	}
+
+	// A request costing more than the whole limit could never pass
+	capacity := rule.Requests
+	if rule.Algorithm == AlgorithmTokenBucket {
+		capacity = rule.Burst
+	}
+	if rule.Requests != -1 && rule.Cost > capacity {
+		return fmt.Errorf("rate limit '%s' has cost %d above its limit of %d", name, rule.Cost, capacity)
+	}
+	return nil
+}
+
+// loadAPIKeys reads an API key to tier mapping from a CSV (key,tier) or YAML (key: tier) file
+func loadAPIKeys(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]string)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &keys); err != nil {
+			return nil, err
+		}
+	case ".csv":
+		records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			if len(record) != 2 {
+				return nil, fmt.Errorf("%s line %d: expected key,tier", path, i+1)
+			}
+			key, tier := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+			// Optional header line
+			if i == 0 && key == "key" && tier == "tier" {
+				continue
+			}
+			keys[key] = tier
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported file type, use .csv, .yaml or .yml", path)
+	}
+	return keys, nil
+}
+
+// validateByteRate defaults the burst of a byte rate to one second of traffic
+func validateByteRate(name string, b *ByteRate) error {
+	if b == nil {
+		return nil
+	}
+	if b.Rate <= 0 {
+		return fmt.Errorf("rate limit '%s' has invalid rate: %d", name, b.Rate)
+	}
+	if b.Burst == 0 {
+		b.Burst = b.Rate
+	}
+	if b.Burst < 0 {
+		return fmt.Errorf("rate limit '%s' has invalid burst: %d", name, b.Burst)
+	}
+	return nil
+}
+
+// validateAdaptive applies defaults to an adaptive limit and validates the result
+func validateAdaptive(name string, a *AdaptiveConfig) error {
+	if a.MinRequests < 1 || a.MaxRequests < a.MinRequests {
+		return fmt.Errorf("rate limit '%s' has invalid adaptive bounds: %d-%d", name, a.MinRequests, a.MaxRequests)
+	}
+	if a.PerSecond < 1 {
+		return fmt.Errorf("rate limit '%s' has invalid adaptive perSecond value: %d", name, a.PerSecond)
+	}
+	if a.Latency < 0 || a.ErrorRate < 0 || a.ErrorRate > 1 {
+		return fmt.Errorf("rate limit '%s' has invalid adaptive thresholds: %v, %g", name, a.Latency, a.ErrorRate)
+	}
+	if a.Interval < 0 || a.Increase < 0 || a.Decrease < 0 || a.Decrease >= 1 {
+		return fmt.Errorf("rate limit '%s' has invalid adaptive steps: %v, %d, %g", name, a.Interval, a.Increase, a.Decrease)
+	}
+
+	if a.ErrorRate == 0 {
+		a.ErrorRate = 0.1
+	}
+	if a.Interval == 0 {
+		a.Interval = 5 * time.Second
+	}
+	if a.Increase == 0 {
+		a.Increase = max((a.MaxRequests-a.MinRequests)/10, 1)
+	}
+	if a.Decrease == 0 {
+		a.Decrease = 0.5
+	}
+	return nil
+}
+
+// validateRequests rejects a limit without requests, an omitted limit would reject every request
+// it applies to. A token bucket may set burst instead.
+func validateRequests(name string, l *LimitConfig) error {
+	if l.Requests == 0 && l.Algorithm != AlgorithmTokenBucket {
+		return fmt.Errorf("rate limit '%s' has no requests, set requests and perSecond (-1 disables limiting)", name)
+	}
+	return nil
+}
+
+// validateLimit applies algorithm defaults to a limit and validates the result
+func (c *config) validateLimit(name string, l *LimitConfig) error {
+	if l.Requests < -1 {
+		return fmt.Errorf("rate limit '%s' has invalid number of requests: %d", name, l.Requests)
+	}
+	if l.PerSecond < -1 {
+		return fmt.Errorf("rate limit '%s' has invalid perSecond value: %d", name, l.PerSecond)
+	}
+
+	if l.Requests == -1 && l.PerSecond != -1 || l.Requests != -1 && l.PerSecond == -1 {
+		return fmt.Errorf("rate limit '%s' has invalid requests and perSecond values: %d, %d", name, l.Requests, l.PerSecond)
+	}
+
+	if l.Mode == "" {
+		l.Mode = ModeEnforce
+	}
+	if l.Mode != ModeEnforce && l.Mode != ModeShadow {
+		return fmt.Errorf("rate limit '%s' has unknown mode: %s", name, l.Mode)
+	}
+
+	if l.MaxWait < 0 || l.QueueSize < 0 {
+		return fmt.Errorf("rate limit '%s' has invalid maxWait and queueSize values: %v, %d", name, l.MaxWait, l.QueueSize)
+	}
+	if l.MaxWait > 0 {
+		if l.Mode == ModeShadow {
+			return fmt.Errorf("rate limit '%s': maxWait cannot be used in %s mode", name, ModeShadow)
+		}
+		if l.QueueSize == 0 {
+			l.QueueSize = 10
+		}
+	}
+
+	// A calendar period implies the calendar algorithm
+	if l.Period != "" && l.Algorithm == "" {
+		l.Algorithm = AlgorithmCalendar
+	}
+
+	switch l.Backend {
+	case "":
+		l.Backend = BackendMemory
+	case BackendMemory:
+	case BackendRedis:
+		if c.Redis == nil {
+			return fmt.Errorf("rate limit '%s' uses the redis backend but redis is not configured", name)
+		}
+		// Redis keeps two counters per key, i.e. the sliding window counter algorithm
+		if l.Algorithm == "" {
+			l.Algorithm = AlgorithmSlidingWindow
+		}
+		if l.Algorithm != AlgorithmSlidingWindow {
+			return fmt.Errorf("rate limit '%s' uses the redis backend which only supports the %s algorithm", name, AlgorithmSlidingWindow)
+		}
+	case BackendGossip:
+		if c.Cluster == nil {
+			return fmt.Errorf("rate limit '%s' uses the gossip backend but cluster is not configured", name)
+		}
+		// Peers exchange per-window counters, i.e. the sliding window counter algorithm
+		if l.Algorithm == "" {
+			l.Algorithm = AlgorithmSlidingWindow
+		}
+		if l.Algorithm != AlgorithmSlidingWindow {
+			return fmt.Errorf("rate limit '%s' uses the gossip backend which only supports the %s algorithm", name, AlgorithmSlidingWindow)
+		}
+	default:
+		return fmt.Errorf("rate limit '%s' has unknown backend: %s", name, l.Backend)
+	}
+
+	if l.Algorithm == "" {
+		l.Algorithm = AlgorithmSlidingLog
+	}
+
+	if l.MaxKeys < 0 {
+		return fmt.Errorf("rate limit '%s' has invalid maxKeys value: %d", name, l.MaxKeys)
+	}
+	if l.MaxKeys > 0 && (l.Backend != BackendMemory || l.Algorithm != AlgorithmSlidingLog) {
+		return fmt.Errorf("rate limit '%s': maxKeys is only supported by the %s algorithm with the %s backend", name, AlgorithmSlidingLog, BackendMemory)
+	}
+
+	if l.Period != "" && l.Algorithm != AlgorithmCalendar {
+		return fmt.Errorf("rate limit '%s': period is only supported by the %s algorithm", name, AlgorithmCalendar)
+	}
+
+	switch l.Algorithm {
+	case AlgorithmSlidingLog:
+		return nil
+	case AlgorithmCalendar:
+		if l.Period != PeriodDay && l.Period != PeriodMonth {
+			return fmt.Errorf("rate limit '%s' has unknown period: %q", name, l.Period)
+		}
+		if l.Requests != -1 && l.Requests <= 0 {
+			return fmt.Errorf("rate limit '%s' has invalid number of requests: %d", name, l.Requests)
+		}
+		loc, err := time.LoadLocation(l.Timezone)
+		if err != nil {
+			return fmt.Errorf("rate limit '%s' has invalid timezone: %w", name, err)
+		}
+		l.Location = loc
+		return nil
+	case AlgorithmTokenBucket:
+		if l.Requests == -1 {
+			// Unlimited host, no bucket needed
+			return nil
+		}
+		// Derive the bucket from requests/perSecond when not set explicitly
+		if l.Burst == 0 {
+			l.Burst = l.Requests
+		}
+		if l.RefillRate == 0 && l.Requests > 0 && l.PerSecond > 0 {
+			l.RefillRate = float64(l.Requests) / float64(l.PerSecond)
+		}
+		if l.Burst <= 0 {
+			return fmt.Errorf("rate limit '%s' has invalid burst value: %d", name, l.Burst)
+		}
+		if l.RefillRate <= 0 {
+			return fmt.Errorf("rate limit '%s' has invalid refillRate value: %g", name, l.RefillRate)
+		}
+		return nil
+	case AlgorithmGCRA, AlgorithmSlidingWindow:
+		if l.Requests == -1 {
+			return nil
+		}
+		if l.Requests <= 0 || l.PerSecond <= 0 {
+			return fmt.Errorf("rate limit '%s' needs positive requests and perSecond for %s: %d, %d", name, l.Algorithm, l.Requests, l.PerSecond)
+		}
+		return nil
+	default:
+		return fmt.Errorf("rate limit '%s' has unknown algorithm: %s", name, l.Algorithm)
+	}
 }
 
 // setPerformanceDefaults sets optimal performance defaults
@@ -196,6 +759,9 @@ func setPerformanceDefaults(config *config) {
 	if config.Server.MaxHeaderBytes == 0 {
 		config.Server.MaxHeaderBytes = 1 << 20 // 1 MB
 	}
+	if config.Server.ProxyProtocol != nil && config.Server.ProxyProtocol.Timeout == 0 {
+		config.Server.ProxyProtocol.Timeout = 5 * time.Second
+	}
 
 	// Transport defaults for performance
 	if config.Transport.MaxIdleConns == 0 {
@@ -210,6 +776,53 @@ func setPerformanceDefaults(config *config) {
 	if config.Transport.TLSHandshakeTimeout == 0 {
 		config.Transport.TLSHandshakeTimeout = 10 * time.Second
 	}
+
+	// Redis defaults
+	if config.Redis != nil {
+		if config.Redis.PoolSize == 0 {
+			config.Redis.PoolSize = 10
+		}
+		if config.Redis.Timeout == 0 {
+			config.Redis.Timeout = 500 * time.Millisecond
+		}
+		if config.Redis.KeyPrefix == "" {
+			config.Redis.KeyPrefix = "rlsp:"
+		}
+		if config.Redis.FailurePolicy == "" {
+			config.Redis.FailurePolicy = FailOpen
+		}
+	}
+
+	// Cluster defaults
+	if config.Cluster != nil {
+		if config.Cluster.NodeID == "" {
+			config.Cluster.NodeID, _ = os.Hostname()
+		}
+		if config.Cluster.Listen == "" {
+			config.Cluster.Listen = ":7946"
+		}
+		if config.Cluster.SyncInterval == 0 {
+			config.Cluster.SyncInterval = time.Second
+		}
+		if config.Cluster.Timeout == 0 {
+			config.Cluster.Timeout = 500 * time.Millisecond
+		}
+	}
+
+	// API key defaults
+	if config.APIKeys != nil {
+		if config.APIKeys.Header == "" {
+			config.APIKeys.Header = "X-API-Key"
+		}
+		if config.APIKeys.AnonymousTier == "" {
+			config.APIKeys.AnonymousTier = "anonymous"
+		}
+	}
+
+	// Persistence defaults
+	if config.Persistence != nil && config.Persistence.Interval == 0 {
+		config.Persistence.Interval = 30 * time.Second
+	}
 }
 
 // overrideWithEnv overrides configuration with environment variables
@@ -274,6 +887,36 @@ func overrideWithEnv(config *config) {
 		}
 	}
 
+	// Redis
+	if config.Redis != nil {
+		if val := os.Getenv("REDIS_ADDRESS"); val != "" {
+			config.Redis.Address = val
+		}
+		if val := os.Getenv("REDIS_PASSWORD"); val != "" {
+			config.Redis.Password = val
+		}
+	}
+
+	// Cluster
+	if config.Cluster != nil {
+		if val := os.Getenv("CLUSTER_NODE_ID"); val != "" {
+			config.Cluster.NodeID = val
+		}
+		if val := os.Getenv("CLUSTER_SECRET"); val != "" {
+			config.Cluster.Secret = val
+		}
+		if val := os.Getenv("CLUSTER_LISTEN"); val != "" {
+			config.Cluster.Listen = val
+		}
+		if val := os.Getenv("CLUSTER_PEERS"); val != "" {
+			peers := strings.Split(val, ",")
+			for i, peer := range peers {
+				peers[i] = strings.TrimSpace(peer)
+			}
+			config.Cluster.Peers = peers
+		}
+	}
+
 	// IP Blacklist from environment
 	if val := os.Getenv("IP_BLACKLIST"); val != "" {
 		ips := strings.Split(val, ",")
@@ -282,4 +925,13 @@ func overrideWithEnv(config *config) {
 		}
 		config.IPBlackList = append(config.IPBlackList, ips...)
 	}
+
+	// IP Allowlist from environment
+	if val := os.Getenv("IP_ALLOWLIST"); val != "" {
+		ips := strings.Split(val, ",")
+		for i, ip := range ips {
+			ips[i] = strings.TrimSpace(ip)
+		}
+		config.IPAllowList = append(config.IPAllowList, ips...)
+	}
 }
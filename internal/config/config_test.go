@@ -0,0 +1,179 @@
+package config
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig loads the yaml as config.yaml of a temporary directory
+func loadTestConfig(t *testing.T, yaml string) (*Config, error) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(dir)
+}
+
+func TestValidateRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    RuleConfig
+		wantErr string // Part of the expected error, empty when the rule is valid
+	}{
+		{"limited", RuleConfig{LimitConfig: LimitConfig{Requests: 10, PerSecond: 60}}, ""},
+		{"unlimited", RuleConfig{LimitConfig: LimitConfig{Requests: -1, PerSecond: -1}}, ""},
+		{"token bucket burst", RuleConfig{LimitConfig: LimitConfig{Algorithm: AlgorithmTokenBucket, Burst: 5, RefillRate: 1}}, ""},
+		{"omitted limit", RuleConfig{}, "has no requests"},
+		{"omitted requests", RuleConfig{LimitConfig: LimitConfig{PerSecond: 60}}, "has no requests"},
+		{"invalid regex", RuleConfig{LimitConfig: LimitConfig{Requests: 10, PerSecond: 60}, PathRegex: "("}, "invalid pathRegex"},
+		{"cost above limit", RuleConfig{LimitConfig: LimitConfig{Requests: 10, PerSecond: 60}, Cost: 11}, "above its limit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config{}
+			err := c.validateRule("example.com", 0, &tt.rule)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_ClusterSecret(t *testing.T) {
+	t.Setenv("CLUSTER_SECRET", "")
+
+	if _, err := loadTestConfig(t, "cluster:\n  nodeId: a\n"); err == nil || !strings.Contains(err.Error(), "secret is missing") {
+		t.Errorf("Expected cluster without secret to be rejected, got %v", err)
+	}
+	cfg, err := loadTestConfig(t, "cluster:\n  nodeId: a\n  secret: s3cret\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Peers push counters to their own listener, never to the public proxy port
+	if cfg.Cluster.Listen != ":7946" {
+		t.Errorf("Expected cluster listener on :7946, got %q", cfg.Cluster.Listen)
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		want    map[string]string
+		wantErr string // Part of the expected error, empty when the file is valid
+	}{
+		{"csv", "keys.csv", "key-a,free\n key-b , pro \n", map[string]string{"key-a": "free", "key-b": "pro"}, ""},
+		{"csv header", "keys.csv", "key,tier\nkey-a,free\n", map[string]string{"key-a": "free"}, ""},
+		{"yaml", "keys.yaml", "key-a: free\nkey-b: pro\n", map[string]string{"key-a": "free", "key-b": "pro"}, ""},
+		{"yml", "keys.yml", "key-a: free\n", map[string]string{"key-a": "free"}, ""},
+		{"csv missing tier", "keys.csv", "key-a\n", nil, "line 1: expected key,tier"},
+		{"csv inconsistent record", "keys.csv", "key-a,free\nkey-b,pro,extra\n", nil, "wrong number of fields"},
+		{"malformed yaml", "keys.yaml", "key-a: [free\n", nil, "yaml"},
+		{"unsupported type", "keys.txt", "key-a free\n", nil, "unsupported file type"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			keys, err := loadAPIKeys(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !maps.Equal(keys, tt.want) {
+				t.Errorf("loadAPIKeys() = %v, want %v", keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_APIKeyUndefinedTier(t *testing.T) {
+	_, err := loadTestConfig(t, "tiers:\n  anonymous: {requests: 10, perSecond: 60}\napiKeys:\n  keys:\n    s3cret-key: gold\n")
+	if err == nil || !strings.Contains(err.Error(), "undefined tier 'gold'") {
+		t.Fatalf("Expected undefined tier to be rejected, got %v", err)
+	}
+	if strings.Contains(err.Error(), "s3cr") {
+		t.Errorf("Error must not reveal the API key: %v", err)
+	}
+}
+
+func TestLoadConfig_OmittedRequests(t *testing.T) {
+	tiers := "tiers:\n  anonymous: {requests: 10, perSecond: 60}\napiKeys:\n  keys: {}\n"
+
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string // Part of the expected error, empty when the config is valid
+	}{
+		{"host limit", "rateLimits:\n  a.example: {destination: http://backend}\n", "'a.example' has no requests"},
+		{"stacked host limit", "rateLimits:\n  a.example:\n    destination: http://backend\n    requests: 10\n    perSecond: 1\n    limits:\n      - {perSecond: 60}\n", "'a.example limit 1' has no requests"},
+		{"tier limit", "tiers:\n  anonymous: {perSecond: 60}\n", "'tier anonymous' has no requests"},
+		{"stacked tier limit", "tiers:\n  anonymous:\n    requests: 10\n    perSecond: 1\n    limits:\n      - {perSecond: 60}\n", "'tier anonymous limit 1' has no requests"},
+		{"tiered host", tiers + "rateLimits:\n  a.example: {destination: http://backend, tiered: true}\n", ""},
+		{"token bucket burst", "rateLimits:\n  a.example: {destination: http://backend, algorithm: token-bucket, burst: 5, refillRate: 1}\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, tt.yaml)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_TrustedProxies(t *testing.T) {
+	cfg, err := loadTestConfig(t, "rateLimits: {}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Private networks are not trusted unless configured
+	want := []string{"127.0.0.0/8", "::1/128"}
+	if len(cfg.IPHeader.Trusted) != len(want) {
+		t.Fatalf("Expected trusted proxies %v, got %v", want, cfg.IPHeader.Trusted)
+	}
+	for i, prefix := range cfg.IPHeader.Trusted {
+		if prefix.String() != want[i] {
+			t.Errorf("Expected trusted proxies %v, got %v", want, cfg.IPHeader.Trusted)
+		}
+	}
+
+	cfg, err = loadTestConfig(t, "ipHeader:\n  headers: [X-Forwarded-For]\n  trustedProxies: [10.0.1.0/24]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.IPHeader.Trusted) != 1 || cfg.IPHeader.Trusted[0].String() != "10.0.1.0/24" {
+		t.Errorf("Expected configured proxies to replace the default, got %v", cfg.IPHeader.Trusted)
+	}
+}
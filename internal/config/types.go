@@ -1,13 +1,27 @@
 package config
 
-import "time"
+import (
+	"net/netip"
+	"regexp"
+	"time"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/clientip"
+)
 
 // ServerConfig represents server-specific configuration
 type ServerConfig struct {
-	ReadTimeout    time.Duration `yaml:"readTimeout"`
-	WriteTimeout   time.Duration `yaml:"writeTimeout"`
-	IdleTimeout    time.Duration `yaml:"idleTimeout"`
-	MaxHeaderBytes int           `yaml:"maxHeaderBytes"`
+	ReadTimeout    time.Duration        `yaml:"readTimeout"`
+	WriteTimeout   time.Duration        `yaml:"writeTimeout"`
+	IdleTimeout    time.Duration        `yaml:"idleTimeout"`
+	MaxHeaderBytes int                  `yaml:"maxHeaderBytes"`
+	ProxyProtocol  *ProxyProtocolConfig `yaml:"proxyProtocol"` // Read client addresses from PROXY protocol headers of load balancers
+}
+
+// ProxyProtocolConfig accepts PROXY protocol (v1 and v2) headers from trusted load balancers
+type ProxyProtocolConfig struct {
+	TrustedProxies []string       `yaml:"trustedProxies"` // CIDRs of load balancers sending the header, required
+	Timeout        time.Duration  `yaml:"timeout"`        // How long a balancer may take to send the header (defaults to 5s)
+	Trusted        []netip.Prefix `yaml:"-"`              // Parsed TrustedProxies
 }
 
 // TransportConfig represents HTTP transport configuration
@@ -19,14 +33,183 @@ type TransportConfig struct {
 	DisableCompression  bool          `yaml:"disableCompression"`
 }
 
+// Rate limiting algorithms selectable via LimitConfig.Algorithm
+const (
+	AlgorithmSlidingLog    = "sliding-log"
+	AlgorithmTokenBucket   = "token-bucket"
+	AlgorithmGCRA          = "gcra"
+	AlgorithmSlidingWindow = "sliding-window"
+	AlgorithmCalendar      = "calendar" // Quota per calendar day or month, see LimitConfig.Period
+)
+
+// Calendar periods selectable via LimitConfig.Period
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// Limiter backends selectable via LimitConfig.Backend
+const (
+	BackendMemory = "memory" // In-process state, per replica
+	BackendRedis  = "redis"  // Shared state in a Redis compatible server
+	BackendGossip = "gossip" // Local state synchronised with peer replicas
+)
+
+// Failure policies of the Redis backend
+const (
+	FailOpen   = "open"   // Allow requests while the server is unreachable
+	FailClosed = "closed" // Reject requests while the server is unreachable
+)
+
+// RedisConfig configures the Redis compatible server shared by all proxy replicas
+type RedisConfig struct {
+	Address       string        `yaml:"address"`
+	Password      string        `yaml:"password"`
+	DB            int           `yaml:"db"`
+	PoolSize      int           `yaml:"poolSize"`
+	Timeout       time.Duration `yaml:"timeout"`
+	KeyPrefix     string        `yaml:"keyPrefix"`
+	FailurePolicy string        `yaml:"failurePolicy"` // open (default) or closed
+}
+
+// ClusterConfig configures the peer-to-peer synchronisation of limiter counters between replicas
+type ClusterConfig struct {
+	NodeID       string        `yaml:"nodeId"`       // Unique name of this replica (defaults to hostname)
+	Listen       string        `yaml:"listen"`       // Address of the listener receiving counters from peers, apart from the proxy (defaults to :7946)
+	Peers        []string      `yaml:"peers"`        // Base URLs of the cluster listeners of the other replicas, e.g. http://10.0.0.2:7946
+	Secret       string        `yaml:"secret"`       // Shared secret authenticating peers, required
+	SyncInterval time.Duration `yaml:"syncInterval"` // How often counters are pushed to peers
+	Timeout      time.Duration `yaml:"timeout"`      // Timeout of a single push
+}
+
+// PersistenceConfig configures snapshots of in-memory limiter state surviving restarts
+type PersistenceConfig struct {
+	Dir      string        `yaml:"dir"`      // Directory holding the snapshot files
+	Interval time.Duration `yaml:"interval"` // How often snapshots are written, also written on shutdown
+}
+
+// AdaptiveConfig lets a host limit follow the health of its backend, shrinking it multiplicatively
+// when responses get slow or fail and growing it additively while the backend is healthy
+type AdaptiveConfig struct {
+	MinRequests int           `yaml:"minRequests"` // Lower bound of the effective limit
+	MaxRequests int           `yaml:"maxRequests"` // Upper bound and starting value of the effective limit
+	PerSecond   int           `yaml:"perSecond"`   // Window length in seconds
+	Latency     time.Duration `yaml:"latency"`     // Mean response time above which the backend is degraded (0 = ignore latency)
+	ErrorRate   float64       `yaml:"errorRate"`   // Share of 5xx responses above which the backend is degraded (defaults to 0.1)
+	Interval    time.Duration `yaml:"interval"`    // How often the limit is adjusted (defaults to 5s)
+	Increase    int           `yaml:"increase"`    // Requests added per healthy interval (defaults to a tenth of the range)
+	Decrease    float64       `yaml:"decrease"`    // Factor applied per degraded interval (defaults to 0.5)
+}
+
+// Forwarding headers sent to backends, selectable via RateLimitConfig.ForwardedHeaders
+const (
+	ForwardedLegacy  = "legacy"  // X-Forwarded-For/Host/Proto
+	ForwardedRFC7239 = "rfc7239" // Forwarded: for=...;proto=...;host=...
+	ForwardedBoth    = "both"
+)
+
+// IP allowlist modes selectable via RateLimitConfig.IPAllowListMode
+const (
+	AllowListExempt   = "exempt"   // Listed clients skip rate limits, the blacklist and auth
+	AllowListRestrict = "restrict" // Only listed clients may access the host
+)
+
+// Limit modes selectable via LimitConfig.Mode
+const (
+	ModeEnforce = "enforce" // Reject requests over the limit
+	ModeShadow  = "shadow"  // Only record requests that would be rejected
+)
+
+// LimitConfig describes a single rate limit and the algorithm enforcing it
+type LimitConfig struct {
+	Algorithm  string         `yaml:"algorithm"`  // sliding-log (default), token-bucket, gcra, sliding-window or calendar
+	Requests   int            `yaml:"requests"`   // Max requests per window, -1 disables limiting
+	PerSecond  int            `yaml:"perSecond"`  // Window length in seconds, -1 disables limiting
+	Burst      int            `yaml:"burst"`      // Token bucket capacity (defaults to requests)
+	RefillRate float64        `yaml:"refillRate"` // Tokens added per second (defaults to requests/perSecond)
+	Mode       string         `yaml:"mode"`       // enforce (default) or shadow
+	Backend    string         `yaml:"backend"`    // memory (default), redis or gossip
+	MaxKeys    int            `yaml:"maxKeys"`    // Max keys tracked in memory, least recently used are evicted (0 = unbounded)
+	MaxWait    time.Duration  `yaml:"maxWait"`    // How long requests over the limit wait for capacity before 429 (0 = reject immediately)
+	QueueSize  int            `yaml:"queueSize"`  // Max requests waiting per key (defaults to 10)
+	Period     string         `yaml:"period"`     // Calendar period of the calendar algorithm: day or month
+	Timezone   string         `yaml:"timezone"`   // IANA timezone of calendar periods (defaults to UTC)
+	Location   *time.Location `yaml:"-"`          // Loaded Timezone
+}
+
+// RuleConfig is a rate limit applied to requests matching a method and path within a host
+type RuleConfig struct {
+	LimitConfig `yaml:",inline"`
+
+	Name       string         `yaml:"name"`
+	Key        string         `yaml:"key"`        // Rate limit key, e.g. "ip" (default), "header:X-API-Key", "ip+path"
+	Methods    []string       `yaml:"methods"`    // HTTP methods, empty matches all
+	PathPrefix string         `yaml:"pathPrefix"` // Path prefix, empty matches all
+	PathRegex  string         `yaml:"pathRegex"`  // Regular expression matched against the path
+	Regexp     *regexp.Regexp `yaml:"-"`          // Compiled PathRegex
+	Cost       int            `yaml:"cost"`       // Units of the limit consumed per request (defaults to 1)
+}
+
+// RateLimitHeaders controls which quota headers are sent to clients
+type RateLimitHeaders struct {
+	Enabled bool `yaml:"enabled"` // RateLimit-Limit/Remaining/Reset on every response
+	Legacy  bool `yaml:"legacy"`  // Also send the X-RateLimit-* variants
+}
+
+// ConcurrencyConfig caps simultaneous in-flight requests of a host
+type ConcurrencyConfig struct {
+	PerKey int `yaml:"perKey"` // Max in-flight requests per rate limit key (0 = unlimited)
+	Total  int `yaml:"total"`  // Max in-flight requests of the host (0 = unlimited)
+}
+
+// ByteRate is a sustained transfer rate with an allowance for bursts
+type ByteRate struct {
+	Rate  int `yaml:"rate"`  // Sustained bytes per second
+	Burst int `yaml:"burst"` // Bytes transferred at full speed before throttling (defaults to rate)
+}
+
+// BandwidthConfig throttles the request and response bodies of a host
+type BandwidthConfig struct {
+	PerKey *ByteRate `yaml:"perKey"` // Per rate limit key
+	Host   *ByteRate `yaml:"host"`   // Shared by all clients of the host
+}
+
+// TierConfig is a client plan with its own limits
+type TierConfig struct {
+	LimitConfig `yaml:",inline"`
+
+	Limits []LimitConfig `yaml:"limits"` // Further limits stacked on the tier limit, e.g. monthly quotas
+}
+
+// APIKeysConfig maps API keys of clients to tiers
+type APIKeysConfig struct {
+	Header        string            `yaml:"header"`        // Header carrying the API key (defaults to X-API-Key)
+	Keys          map[string]string `yaml:"keys"`          // API key -> tier
+	File          string            `yaml:"file"`          // CSV (key,tier) or YAML (key: tier) file with further keys
+	AnonymousTier string            `yaml:"anonymousTier"` // Tier of requests without a known API key (defaults to anonymous)
+}
+
 // Local types
 type rateLimitConfig struct {
-	Destination   string      `yaml:"destination"`
-	Requests      int         `yaml:"requests"`
-	PerSecond     int         `yaml:"perSecond"`
-	IPBlackList   []string    `yaml:"ipBlackList"`
-	AllowedEmails []string    `yaml:"allowedEmails"`
-	Auth          *DomainAuth `yaml:"auth"`
+	LimitConfig `yaml:",inline"`
+
+	Destination      string             `yaml:"destination"`
+	IPBlackList      []string           `yaml:"ipBlackList"`     // IPs and CIDR ranges, e.g. 203.0.113.0/24
+	IPAllowList      []string           `yaml:"ipAllowList"`     // IPs and CIDR ranges evaluated before the blacklist and limits
+	IPAllowListMode  string             `yaml:"ipAllowListMode"` // exempt or restrict (defaults to the global mode)
+	AllowedEmails    []string           `yaml:"allowedEmails"`
+	Auth             *DomainAuth        `yaml:"auth"`
+	Headers          RateLimitHeaders   `yaml:"headers"`
+	Shadow           *LimitConfig       `yaml:"shadow"`           // Extra limit evaluated in shadow mode only
+	Rules            []RuleConfig       `yaml:"rules"`            // Ordered rules, the first match wins over the host limit
+	Key              string             `yaml:"key"`              // Rate limit key of the host limit, see RuleConfig.Key
+	Concurrency      *ConcurrencyConfig `yaml:"concurrency"`      // In-flight request caps, keyed like the host limit
+	Bandwidth        *BandwidthConfig   `yaml:"bandwidth"`        // Byte rate caps, keyed like the host limit
+	Limits           []LimitConfig      `yaml:"limits"`           // Further limits stacked on the host limit, all must pass
+	Tiered           bool               `yaml:"tiered"`           // Limit clients by the tier of their API key instead of the host limit
+	CostHeader       string             `yaml:"costHeader"`       // Backend response header with the actual cost of a request, e.g. X-RateLimit-Cost
+	Adaptive         *AdaptiveConfig    `yaml:"adaptive"`         // Host-wide limit following backend health, memory backend only
+	ForwardedHeaders string             `yaml:"forwardedHeaders"` // Forwarding headers sent to the backend: legacy (default), rfc7239 or both
 }
 
 // DomainAuth represents authentication configuration for a specific domain
@@ -36,26 +219,49 @@ type DomainAuth struct {
 }
 
 type config struct {
-	IPHeader    IPHeaderConfig             `yaml:"ipHeader"`
-	GoogleAuth  *GoogleAuth                `yaml:"googleAuth"`
-	RateLimits  map[string]rateLimitConfig `yaml:"rateLimits"`
-	IPBlackList []string                   `yaml:"ipBlackList"`
-	Server      ServerConfig               `yaml:"server"`
-	Transport   TransportConfig            `yaml:"transport"`
+	IPHeader        IPHeaderConfig             `yaml:"ipHeader"`
+	GoogleAuth      *GoogleAuth                `yaml:"googleAuth"`
+	RateLimits      map[string]rateLimitConfig `yaml:"rateLimits"`
+	IPBlackList     []string                   `yaml:"ipBlackList"`     // IPs and CIDR ranges blocked on every host
+	IPAllowList     []string                   `yaml:"ipAllowList"`     // IPs and CIDR ranges allowed on every host, e.g. office and monitoring
+	IPAllowListMode string                     `yaml:"ipAllowListMode"` // Default mode of the host allowlists: exempt (default) or restrict
+	IPv6KeyPrefix   int                        `yaml:"ipv6KeyPrefix"`   // Aggregate IPv6 clients to this prefix length in limiter keys, e.g. 64 (0 = full address)
+	Server          ServerConfig               `yaml:"server"`
+	Transport       TransportConfig            `yaml:"transport"`
+	Redis           *RedisConfig               `yaml:"redis"`
+	Cluster         *ClusterConfig             `yaml:"cluster"`
+	Persistence     *PersistenceConfig         `yaml:"persistence"`
+	Tiers           map[string]TierConfig      `yaml:"tiers"`
+	APIKeys         *APIKeysConfig             `yaml:"apiKeys"`
 }
 
 // Global types
 type IPHeaderConfig struct {
-	Headers []string `yaml:"headers"`
+	Headers        []string       `yaml:"headers"`        // Sources of the client IP in order, RemoteAddr is the connection peer
+	TrustedProxies []string       `yaml:"trustedProxies"` // CIDRs of proxies whose headers are believed (defaults to loopback only)
+	Trusted        []netip.Prefix `yaml:"-"`              // Parsed TrustedProxies
 }
 
 type RateLimitConfig struct {
-	Destination   string          `yaml:"destination"`
-	Requests      int             `yaml:"requests"`
-	PerSecond     int             `yaml:"perSecond"`
-	IPBlackList   map[string]bool `yaml:"ipBlackList"`
-	AllowedEmails []string        `yaml:"allowedEmails"`
-	Auth          *DomainAuth     `yaml:"auth"`
+	LimitConfig `yaml:",inline"`
+
+	Destination      string               `yaml:"destination"`
+	IPBlackList      *clientip.PrefixTrie `yaml:"-"`               // Blacklisted IPs and CIDR ranges of the host and the global list
+	IPAllowList      *clientip.PrefixTrie `yaml:"-"`               // Allowlisted IPs and CIDR ranges of the host and the global list
+	IPAllowListMode  string               `yaml:"ipAllowListMode"` // exempt or restrict
+	AllowedEmails    []string             `yaml:"allowedEmails"`
+	Auth             *DomainAuth          `yaml:"auth"`
+	Headers          RateLimitHeaders     `yaml:"headers"`
+	Shadow           *LimitConfig         `yaml:"shadow"`           // Extra limit evaluated in shadow mode only
+	Rules            []RuleConfig         `yaml:"rules"`            // Ordered rules, the first match wins over the host limit
+	Key              string               `yaml:"key"`              // Rate limit key of the host limit, see RuleConfig.Key
+	Concurrency      *ConcurrencyConfig   `yaml:"concurrency"`      // In-flight request caps, keyed like the host limit
+	Bandwidth        *BandwidthConfig     `yaml:"bandwidth"`        // Byte rate caps, keyed like the host limit
+	Limits           []LimitConfig        `yaml:"limits"`           // Further limits stacked on the host limit, all must pass
+	Tiered           bool                 `yaml:"tiered"`           // Limit clients by the tier of their API key instead of the host limit
+	CostHeader       string               `yaml:"costHeader"`       // Backend response header with the actual cost of a request, e.g. X-RateLimit-Cost
+	Adaptive         *AdaptiveConfig      `yaml:"adaptive"`         // Host-wide limit following backend health, memory backend only
+	ForwardedHeaders string               `yaml:"forwardedHeaders"` // Forwarding headers sent to the backend: legacy (default), rfc7239 or both
 }
 
 type GoogleAuth struct {
@@ -75,9 +281,15 @@ type DomainGroup struct {
 }
 
 type Config struct {
-	IPHeader   IPHeaderConfig             `yaml:"ipHeader"`
-	GoogleAuth *GoogleAuth                `yaml:"googleAuth"`
-	RateLimits map[string]RateLimitConfig `yaml:"rateLimits"`
-	Server     ServerConfig               `yaml:"server"`
-	Transport  TransportConfig            `yaml:"transport"`
+	IPHeader      IPHeaderConfig             `yaml:"ipHeader"`
+	GoogleAuth    *GoogleAuth                `yaml:"googleAuth"`
+	RateLimits    map[string]RateLimitConfig `yaml:"rateLimits"`
+	IPv6KeyPrefix int                        `yaml:"ipv6KeyPrefix"` // Aggregate IPv6 clients to this prefix length in limiter keys, 0 = full address
+	Server        ServerConfig               `yaml:"server"`
+	Transport     TransportConfig            `yaml:"transport"`
+	Redis         *RedisConfig               `yaml:"redis"`
+	Cluster       *ClusterConfig             `yaml:"cluster"`
+	Persistence   *PersistenceConfig         `yaml:"persistence"`
+	Tiers         map[string]TierConfig      `yaml:"tiers"`
+	APIKeys       *APIKeysConfig             `yaml:"apiKeys"`
 }
@@ -6,11 +6,19 @@ import (
 )
 
 type Metric struct {
-	RequestsTotal     *prometheus.CounterVec
-	ResponseTime      *prometheus.HistogramVec
-	ResponseStatus    *prometheus.CounterVec
-	RateLimitHits     *prometheus.CounterVec
-	ActiveConnections *prometheus.GaugeVec
+	RequestsTotal       *prometheus.CounterVec
+	ResponseTime        *prometheus.HistogramVec
+	ResponseStatus      *prometheus.CounterVec
+	RateLimitHits       *prometheus.CounterVec
+	RateLimitWouldBlock *prometheus.CounterVec
+	RateLimitRemaining  *prometheus.HistogramVec
+	RateLimitQueueDepth *prometheus.GaugeVec
+	RateLimitQueueWait  *prometheus.HistogramVec
+	LimiterTrackedKeys  *prometheus.GaugeVec
+	LimiterEvictions    *prometheus.CounterVec
+	BandwidthThrottled  *prometheus.CounterVec
+	EffectiveLimit      *prometheus.GaugeVec
+	ActiveConnections   *prometheus.GaugeVec
 }
 
 func NewMetric() *Metric {
@@ -37,16 +45,67 @@ func NewMetric() *Metric {
 		Help: "The total number of rate limit hits",
 	}, []string{"origin", "ip"})
 
+	rateLimitWouldBlock := promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlsp_rate_limit_would_block_total",
+		Help: "The total number of requests a shadow rate limit would have blocked",
+	}, []string{"origin", "rule"})
+
+	// Share of the limit left after each request, shows how close clients run to the limit
+	rateLimitRemaining := promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rlsp_rate_limit_remaining_ratio",
+		Help:    "Remaining share of the rate limit after each request",
+		Buckets: []float64{0, .1, .25, .5, .75, .9, 1},
+	}, []string{"origin"})
+
+	rateLimitQueueDepth := promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rlsp_rate_limit_queue_depth",
+		Help: "The number of requests waiting for rate limit capacity",
+	}, []string{"origin"})
+
+	rateLimitQueueWait := promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rlsp_rate_limit_queue_wait_seconds",
+		Help:    "Time requests spent waiting for rate limit capacity",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 2, 5, 10, 30},
+	}, []string{"origin"})
+
+	limiterTrackedKeys := promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rlsp_rate_limit_tracked_keys",
+		Help: "The number of keys tracked in memory by a rate limiter",
+	}, []string{"limiter"})
+
+	limiterEvictions := promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlsp_rate_limit_evictions_total",
+		Help: "The total number of keys evicted from a rate limiter to stay within maxKeys",
+	}, []string{"limiter"})
+
+	bandwidthThrottled := promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlsp_bandwidth_throttled_bytes_total",
+		Help: "The total number of bytes delayed by bandwidth limits",
+	}, []string{"origin", "direction"})
+
+	effectiveLimit := promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rlsp_rate_limit_effective_limit",
+		Help: "The current limit of an adaptive rate limit, lowered while the backend is degraded",
+	}, []string{"origin"})
+
 	activeConnections := promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "rlsp_active_connections",
 		Help: "The number of active connections",
 	}, []string{"origin"})
 
 	return &Metric{
-		RequestsTotal:     requestsTotal,
-		ResponseTime:      responseTime,
-		ResponseStatus:    responseStatus,
-		RateLimitHits:     rateLimitHits,
-		ActiveConnections: activeConnections,
+		RequestsTotal:       requestsTotal,
+		ResponseTime:        responseTime,
+		ResponseStatus:      responseStatus,
+		RateLimitHits:       rateLimitHits,
+		RateLimitWouldBlock: rateLimitWouldBlock,
+		RateLimitRemaining:  rateLimitRemaining,
+		RateLimitQueueDepth: rateLimitQueueDepth,
+		RateLimitQueueWait:  rateLimitQueueWait,
+		LimiterTrackedKeys:  limiterTrackedKeys,
+		LimiterEvictions:    limiterEvictions,
+		BandwidthThrottled:  bandwidthThrottled,
+		EffectiveLimit:      effectiveLimit,
+		ActiveConnections:   activeConnections,
 	}
 }
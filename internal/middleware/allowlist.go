@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
+)
+
+// exemptKey marks requests of allowlisted clients in their context
+type exemptKey struct{}
+
+// AllowListMiddleware evaluates the IP allowlist of a host before any other check. In exempt mode
+// listed clients skip the blacklist, rate limits and auth, in restrict mode all other clients are rejected.
+type AllowListMiddleware struct {
+	config *config.Config
+	host   string
+	getIP  func(*http.Request) string
+}
+
+// NewAllowListMiddleware creates a new allowlist middleware, it has to wrap the other middlewares
+func NewAllowListMiddleware(cfg *config.Config, host string, getIP func(*http.Request) string) *AllowListMiddleware {
+	return &AllowListMiddleware{
+		config: cfg,
+		host:   host,
+		getIP:  getIP,
+	}
+}
+
+// Handle processes the allowlist middleware
+func (m *AllowListMiddleware) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, ok := m.config.RateLimits[m.host]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		clientIP := m.getIP(r)
+		listed := target.IPAllowList.ContainsString(clientIP)
+		switch target.IPAllowListMode {
+		case config.AllowListRestrict:
+			if !listed {
+				http.Error(w, fmt.Sprintf("Access denied. Your IP (%s) is not allowed.", clientIP), http.StatusForbidden)
+				return
+			}
+		case config.AllowListExempt:
+			if listed {
+				r = r.WithContext(context.WithValue(r.Context(), exemptKey{}, true))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Exempt reports whether the request comes from a client the allowlist exempts from limits and auth
+func Exempt(r *http.Request) bool {
+	exempt, _ := r.Context().Value(exemptKey{}).(bool)
+	return exempt
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/clientip"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/storage"
+)
+
+// newAllowListHandler returns a handler allowing one request per minute, with the office
+// network 192.0.2.0/24 on the allowlist and 192.0.2.66 also on the blacklist
+func newAllowListHandler(t *testing.T, mode string) http.Handler {
+	t.Helper()
+
+	limiter := storage.NewIPRateLimiter(60, 1)
+	t.Cleanup(func() { limiter.Close() })
+
+	target := config.RateLimitConfig{
+		IPAllowList:     clientip.NewPrefixTrie(netip.MustParsePrefix("192.0.2.0/24")),
+		IPAllowListMode: mode,
+		IPBlackList:     clientip.NewPrefixTrie(netip.MustParsePrefix("192.0.2.66/32")),
+	}
+	cfg := &config.Config{RateLimits: map[string]config.RateLimitConfig{"example.com": target}}
+	handler := newTestHandler(target, []Rule{hostRule(Limiter{Name: "default", Storage: limiter})}, ok)
+	return NewAllowListMiddleware(cfg, "example.com", testClientIP).Handle(handler)
+}
+
+func TestAllowList(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		client string
+		want   []int // Status codes of consecutive requests
+	}{
+		{"exempt client skips the limit", config.AllowListExempt, "192.0.2.10", []int{200, 200, 200}},
+		{"exempt client skips the blacklist", config.AllowListExempt, "192.0.2.66", []int{200}},
+		{"other client is limited", config.AllowListExempt, "198.51.100.1", []int{200, 429}},
+		{"restrict rejects other clients", config.AllowListRestrict, "198.51.100.1", []int{403}},
+		{"restrict still limits listed clients", config.AllowListRestrict, "192.0.2.10", []int{200, 429}},
+		{"restrict still applies the blacklist", config.AllowListRestrict, "192.0.2.66", []int{403}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newAllowListHandler(t, tt.mode)
+			for i, want := range tt.want {
+				if got := serveTest(handler, http.MethodGet, "/", tt.client).Code; got != want {
+					t.Errorf("Request %d: got status %d, want %d", i+1, got, want)
+				}
+			}
+		})
+	}
+}
@@ -45,6 +45,12 @@ func (m *AuthMiddleware) Handle(next http.Handler) http.Handler {
 			return
 		}
 
+		// Allowlisted clients skip the login
+		if Exempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// Check if the domain is protected
 		isProtected := false
 		for _, domain := range m.config.GoogleAuth.ProtectedDomains {
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// costWriter takes the request cost reported by the backend out of the response headers
+type costWriter struct {
+	http.ResponseWriter
+	header      string // Response header carrying the cost
+	cost        int    // Reported cost, zero when the backend sent none or an invalid one
+	wroteHeader bool
+}
+
+func (w *costWriter) WriteHeader(statusCode int) {
+	// Informational responses are followed by the final one carrying the cost
+	if !w.wroteHeader && statusCode >= http.StatusOK {
+		w.wroteHeader = true
+		if value := w.Header().Get(w.header); value != "" {
+			w.cost, _ = strconv.Atoi(value)
+			w.Header().Del(w.header)
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *costWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *costWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, fmt.Errorf("underlying ResponseWriter does not implement http.Hijacker")
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (w *costWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/storage"
+)
+
+func TestRateLimitMiddleware_Cost(t *testing.T) {
+	// The calendar quota counts units exactly and rejected requests consume nothing
+	limiter := storage.NewCalendarLimiter(storage.CalendarDay, time.UTC, 10)
+	defer limiter.Close()
+
+	search := hostRule(Limiter{Name: "default", Storage: limiter})
+	search.Name, search.Methods, search.Cost = "search", []string{http.MethodPost}, 5
+	rules := []Rule{search, hostRule(Limiter{Name: "default", Storage: limiter})}
+
+	handler := newTestHandler(config.RateLimitConfig{CostHeader: "X-RateLimit-Cost"}, rules, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Cost", r.URL.Query().Get("cost"))
+		w.WriteHeader(http.StatusOK)
+	})
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		return serveTest(handler, method, target, "192.168.1.1")
+	}
+
+	// A request above the whole limit is rejected without consuming anything
+	remaining := func() int {
+		return limiter.DecideN("192.168.1.1", 11).Remaining
+	}
+
+	// Upfront cost of the rule
+	serve(http.MethodPost, "/search")
+	if left := remaining(); left != 5 {
+		t.Errorf("Expected POST to consume 5 units, %d left", left)
+	}
+
+	// Backend reported cost on top of the single unit charged upfront
+	rec := serve(http.MethodGet, "/report?cost=3")
+	if rec.Header().Get("X-RateLimit-Cost") != "" {
+		t.Error("Cost header should not reach the client")
+	}
+	if left := remaining(); left != 2 {
+		t.Errorf("Expected reported cost 3 to be charged, %d left", left)
+	}
+
+	// A reported cost above the remaining quota drains it
+	serve(http.MethodGet, "/report?cost=4")
+	if left := remaining(); left != 0 {
+		t.Errorf("Expected quota to be drained, %d left", left)
+	}
+	if code := serve(http.MethodGet, "/").Code; code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 once the quota is used up, got %d", code)
+	}
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// quotaHeaderWriter keeps the quota headers of the proxy in the response. The reverse proxy
+// appends the backend's headers to the ones already set, so a backend sending its own
+// RateLimit-* headers would otherwise give the client two values, the proxy's values win.
+type quotaHeaderWriter struct {
+	http.ResponseWriter
+	quota       http.Header // Headers written by setRateLimitHeaders
+	wroteHeader bool
+}
+
+func (w *quotaHeaderWriter) WriteHeader(statusCode int) {
+	// Informational responses are followed by the final one carrying the quota
+	if !w.wroteHeader && statusCode >= http.StatusOK {
+		w.wroteHeader = true
+		for name, values := range w.quota {
+			w.Header()[name] = values
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *quotaHeaderWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *quotaHeaderWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, fmt.Errorf("underlying ResponseWriter does not implement http.Hijacker")
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (w *quotaHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// KeyExtractor derives the rate limit key of a request
+type KeyExtractor interface {
+	// Extract returns the key and whether the request carries the value at all
+	Extract(r *http.Request) (string, bool)
+}
+
+// NewKeyExtractor builds a key extractor from a specification. Supported parts are
+// "ip", "header:<name>", "cookie:<name>", "email", "path" and "segment:<n>",
+// joined with "+" for composite keys (e.g. "ip+path"). An empty spec means "ip".
+// Requests missing a part of the key are limited by their IP address instead.
+func NewKeyExtractor(spec string, getIP func(*http.Request) string) (KeyExtractor, error) {
+	if spec == "" || spec == "ip" {
+		return ipKey{getIP: getIP}, nil
+	}
+
+	var parts []KeyExtractor
+	for _, part := range strings.Split(spec, "+") {
+		kind, arg, _ := strings.Cut(strings.TrimSpace(part), ":")
+
+		switch kind {
+		case "ip":
+			parts = append(parts, ipKey{getIP: getIP})
+		case "header":
+			if arg == "" {
+				return nil, fmt.Errorf("key part %q is missing header name", part)
+			}
+			parts = append(parts, headerKey{name: arg})
+		case "cookie":
+			if arg == "" {
+				return nil, fmt.Errorf("key part %q is missing cookie name", part)
+			}
+			parts = append(parts, cookieKey{name: arg})
+		case "email":
+			// Cookie set by auth.GoogleAuthenticator after login
+			parts = append(parts, cookieKey{name: "google_auth"})
+		case "path":
+			parts = append(parts, pathKey{})
+		case "segment":
+			index, err := strconv.Atoi(arg)
+			if err != nil || index < 1 {
+				return nil, fmt.Errorf("key part %q needs a segment number starting at 1", part)
+			}
+			parts = append(parts, segmentKey{index: index})
+		default:
+			return nil, fmt.Errorf("unknown key part %q", part)
+		}
+	}
+
+	return &compositeKey{parts: parts, fallback: ipKey{getIP: getIP}}, nil
+}
+
+// ipKey uses the client IP address
+type ipKey struct {
+	getIP func(*http.Request) string
+}
+
+func (k ipKey) Extract(r *http.Request) (string, bool) {
+	return k.getIP(r), true
+}
+
+// headerKey uses a hash of a request header, e.g. an API key, so the secret is never stored
+type headerKey struct {
+	name string
+}
+
+func (k headerKey) Extract(r *http.Request) (string, bool) {
+	value := r.Header.Get(k.name)
+	if value == "" {
+		return "", false
+	}
+	return hashAPIKey(value), true
+}
+
+// cookieKey uses a hash of a cookie, e.g. a session, so the secret is never stored
+type cookieKey struct {
+	name string
+}
+
+func (k cookieKey) Extract(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(k.name)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return hashAPIKey(cookie.Value), true
+}
+
+// pathKey uses the whole request path
+type pathKey struct{}
+
+func (k pathKey) Extract(r *http.Request) (string, bool) {
+	return r.URL.Path, true
+}
+
+// segmentKey uses a single path segment, e.g. the tenant in /tenants/{id}/...
+type segmentKey struct {
+	index int
+}
+
+func (k segmentKey) Extract(r *http.Request) (string, bool) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if k.index > len(segments) || segments[k.index-1] == "" {
+		return "", false
+	}
+	return segments[k.index-1], true
+}
+
+// compositeKey joins several parts, falling back to the IP when any part is missing
+type compositeKey struct {
+	parts    []KeyExtractor
+	fallback KeyExtractor
+}
+
+func (k *compositeKey) Extract(r *http.Request) (string, bool) {
+	values := make([]string, 0, len(k.parts))
+	for _, part := range k.parts {
+		value, ok := part.Extract(r)
+		if !ok {
+			ip, _ := k.fallback.Extract(r)
+			// Prefixed so anonymous clients never share a key with a real value
+			return "ip:" + ip, true
+		}
+		values = append(values, value)
+	}
+	return strings.Join(values, "|"), true
+}
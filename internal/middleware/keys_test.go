@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKeyExtractor(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		path    string
+		header  string // Value of X-API-Key, empty when not sent
+		cookie  string // Value of the session cookie, empty when not sent
+		email   string // Value of the google_auth cookie, empty when not sent
+		wantKey string
+	}{
+		{"empty spec is ip", "", "/", "", "", "", "192.168.1.1"},
+		{"ip", "ip", "/", "key-1", "", "", "192.168.1.1"},
+		{"header", "header:X-API-Key", "/", "key-1", "", "", hashAPIKey("key-1")},
+		{"missing header falls back to ip", "header:X-API-Key", "/", "", "", "", "ip:192.168.1.1"},
+		{"cookie", "cookie:session", "/", "", "s-1", "", hashAPIKey("s-1")},
+		{"missing cookie falls back to ip", "cookie:session", "/", "", "", "", "ip:192.168.1.1"},
+		{"email", "email", "/", "", "", "user@example.com", hashAPIKey("user@example.com")},
+		{"path", "path", "/api/users", "", "", "", "/api/users"},
+		{"segment", "segment:2", "/tenants/acme/users", "", "", "", "acme"},
+		{"first segment", "segment:1", "/tenants/acme", "", "", "", "tenants"},
+		{"segment out of range", "segment:3", "/tenants/acme", "", "", "", "ip:192.168.1.1"},
+		{"empty segment", "segment:2", "/tenants//users", "", "", "", "ip:192.168.1.1"},
+		{"segment of root", "segment:1", "/", "", "", "", "ip:192.168.1.1"},
+		{"composite", "ip+path", "/search", "", "", "", "192.168.1.1|/search"},
+		{"composite with spaces", "header:X-API-Key + segment:1", "/orders/1", "key-1", "", "", hashAPIKey("key-1") + "|orders"},
+		{"composite missing a part", "header:X-API-Key+path", "/search", "", "", "", "ip:192.168.1.1"},
+	}
+
+	getIP := func(r *http.Request) string { return "192.168.1.1" }
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extractor, err := NewKeyExtractor(tt.spec, getIP)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			if tt.header != "" {
+				r.Header.Set("X-API-Key", tt.header)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "session", Value: tt.cookie})
+			}
+			if tt.email != "" {
+				r.AddCookie(&http.Cookie{Name: "google_auth", Value: tt.email})
+			}
+
+			if key, ok := extractor.Extract(r); key != tt.wantKey || !ok {
+				t.Errorf("Extract() = %q, %v, want %q, true", key, ok, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestKeyExtractor_InvalidSpec(t *testing.T) {
+	specs := []string{
+		"header",
+		"header:",
+		"cookie",
+		"segment",
+		"segment:0",
+		"segment:-1",
+		"segment:x",
+		"ip+unknown",
+		"ip+",
+	}
+
+	for _, spec := range specs {
+		if _, err := NewKeyExtractor(spec, nil); err == nil {
+			t.Errorf("Expected spec %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/storage"
+)
+
+// minQueueDelay is the shortest wait between two attempts of a queued request
+const minQueueDelay = 10 * time.Millisecond
+
+// WaitQueue lets requests over the limit wait for capacity instead of being
+// rejected right away. Every key has a bounded number of waiting requests.
+type WaitQueue struct {
+	maxWait time.Duration
+	size    int
+	mu      sync.Mutex
+	waiting map[string]int // key -> waiting requests
+}
+
+// NewWaitQueue creates a queue holding at most size requests per key for up to maxWait
+func NewWaitQueue(maxWait time.Duration, size int) *WaitQueue {
+	return &WaitQueue{
+		maxWait: maxWait,
+		size:    size,
+		waiting: make(map[string]int),
+	}
+}
+
+// enter reserves a place in the queue of the key, it reports false when the queue is full
+func (q *WaitQueue) enter(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.waiting[key] >= q.size {
+		return false
+	}
+	q.waiting[key]++
+	return true
+}
+
+// leave gives back a place taken by enter
+func (q *WaitQueue) leave(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.waiting[key] <= 1 {
+		delete(q.waiting, key)
+	} else {
+		q.waiting[key]--
+	}
+}
+
+// wait retries a rejected request whenever the limiter expects capacity until it is
+// allowed, the request is cancelled or capacity cannot be expected within maxWait.
+// Retries only check the enforced limiters, they are charged once the request passes.
+func (m *RateLimitMiddleware) wait(rule *Rule, r *http.Request, decision storage.Decision) storage.Decision {
+	key, limiters := rule.limiters(r)
+	if !rule.Queue.enter(key) {
+		return decision
+	}
+	defer rule.Queue.leave(key)
+
+	if m.metric != nil {
+		depth := m.metric.RateLimitQueueDepth.WithLabelValues(m.host)
+		depth.Inc()
+		defer depth.Dec()
+	}
+
+	storages := enforced(limiters)
+	cost := rule.cost()
+	start := time.Now()
+	deadline := start.Add(rule.Queue.maxWait)
+	timer := time.NewTimer(0)
+	<-timer.C
+	defer timer.Stop()
+
+	for !decision.Allowed {
+		delay := max(decision.RetryAfter, minQueueDelay)
+		if time.Now().Add(delay).After(deadline) {
+			break
+		}
+
+		timer.Reset(delay)
+		select {
+		case <-r.Context().Done():
+			return decision
+		case <-timer.C:
+		}
+
+		if decision = peek(storages, key, cost); decision.Allowed {
+			decision = commit(storages, key, cost)
+		}
+	}
+
+	if m.metric != nil {
+		m.metric.RateLimitQueueWait.WithLabelValues(m.host).Observe(time.Since(start).Seconds())
+	}
+	return decision
+}
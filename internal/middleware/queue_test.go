@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/storage"
+)
+
+// newQueuedHandler returns a handler allowing one request per second and queueing the rest
+func newQueuedHandler(t *testing.T, queue *WaitQueue) http.Handler {
+	t.Helper()
+
+	limiter := storage.NewIPRateLimiter(1, 1)
+	t.Cleanup(func() { limiter.Close() })
+
+	rule := hostRule(Limiter{Name: "default", Storage: limiter})
+	rule.Queue = queue
+	return newTestHandler(config.RateLimitConfig{}, []Rule{rule}, ok)
+}
+
+func TestWaitQueue_WaitsForCapacity(t *testing.T) {
+	handler := newQueuedHandler(t, NewWaitQueue(2*time.Second, 1))
+
+	serveTest(handler, http.MethodGet, "/", "192.168.1.1")
+
+	start := time.Now()
+	if code := serveTest(handler, http.MethodGet, "/", "192.168.1.1").Code; code != http.StatusOK {
+		t.Errorf("Expected queued request to pass, got %d", code)
+	}
+	if waited := time.Since(start); waited < 900*time.Millisecond {
+		t.Errorf("Expected request to wait for the window, waited %v", waited)
+	}
+}
+
+func TestWaitQueue_RejectsWhenWaitTooLong(t *testing.T) {
+	handler := newQueuedHandler(t, NewWaitQueue(100*time.Millisecond, 1))
+
+	serveTest(handler, http.MethodGet, "/", "192.168.1.1")
+
+	start := time.Now()
+	if code := serveTest(handler, http.MethodGet, "/", "192.168.1.1").Code; code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", code)
+	}
+	if waited := time.Since(start); waited > 50*time.Millisecond {
+		t.Errorf("Expected immediate rejection when capacity is not expected in time, waited %v", waited)
+	}
+}
+
+func TestWaitQueue_Cancelled(t *testing.T) {
+	handler := newQueuedHandler(t, NewWaitQueue(2*time.Second, 1))
+
+	serveTest(handler, http.MethodGet, "/", "192.168.1.1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("X-Forwarded-For", "192.168.1.1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if code := rec.Code; code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for cancelled request, got %d", code)
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("Expected cancellation to stop waiting, waited %v", waited)
+	}
+}
+
+func TestWaitQueue_Full(t *testing.T) {
+	queue := NewWaitQueue(2*time.Second, 1)
+	handler := newQueuedHandler(t, queue)
+
+	serveTest(handler, http.MethodGet, "/", "192.168.1.1")
+
+	// Another request of the same key already waits
+	queue.enter("192.168.1.1")
+	defer queue.leave("192.168.1.1")
+
+	if code := serveTest(handler, http.MethodGet, "/", "192.168.1.1").Code; code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 when the queue is full, got %d", code)
+	}
+}
+
+// countingStorage counts the requests charged to a storage
+type countingStorage struct {
+	storage.Storage
+	decided int
+}
+
+func (s *countingStorage) DecideN(key string, n int) storage.Decision {
+	s.decided++
+	return s.Storage.DecideN(key, n)
+}
+
+func TestWaitQueue_ChargesOnce(t *testing.T) {
+	limit := &countingStorage{Storage: storage.NewIPRateLimiter(1, 1)}
+	defer limit.Close()
+	shadow := &countingStorage{Storage: storage.NewIPRateLimiter(60, 100)}
+	defer shadow.Close()
+
+	rule := hostRule(Limiter{Name: "default", Storage: limit}, Limiter{Name: "dry-run", Storage: shadow, Shadow: true})
+	rule.Queue = NewWaitQueue(2*time.Second, 1)
+	handler := newTestHandler(config.RateLimitConfig{}, []Rule{rule}, ok)
+
+	serveTest(handler, http.MethodGet, "/", "192.168.1.1")
+	if rec := serveTest(handler, http.MethodGet, "/", "192.168.1.1"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected queued request to pass, got %d", rec.Code)
+	}
+
+	// Retries only check the limits, the queued request is charged once it passes
+	if limit.decided != 3 {
+		t.Errorf("Expected the enforced limit to be charged 3 times, got %d", limit.decided)
+	}
+	if shadow.decided != 2 {
+		t.Errorf("Expected the shadow limit to see every request once, got %d", shadow.decided)
+	}
+}
+
+func TestWaitQueue_TierKey(t *testing.T) {
+	limiter := storage.NewIPRateLimiter(1, 1)
+	defer limiter.Close()
+
+	rule := hostRule()
+	rule.Tiers = NewTierResolver("X-API-Key", map[string]string{"key-pro": "pro"},
+		map[string]*Tier{"pro": {Name: "pro", Limiters: []Limiter{{Name: "pro", Storage: limiter}}}}, "pro")
+	rule.Queue = NewWaitQueue(2*time.Second, 1)
+	handler := newTestHandler(config.RateLimitConfig{}, []Rule{rule}, ok)
+
+	serveAPIKey(handler, "key-pro")
+
+	// The queue is keyed like the limits, by the API key rather than the client IP
+	rule.Queue.enter(hashAPIKey("key-pro"))
+	defer rule.Queue.leave(hashAPIKey("key-pro"))
+
+	if code := serveAPIKey(handler, "key-pro"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 when the queue of the API key is full, got %d", code)
+	}
+}
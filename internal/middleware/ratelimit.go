@@ -2,30 +2,91 @@ package middleware
 
 import (
 	"fmt"
+	"log"
 	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
 	"github.com/JaLe29/ratelimit-simple-proxy/internal/metric"
 	"github.com/JaLe29/ratelimit-simple-proxy/internal/storage"
 )
 
+// Limiter is a limiter storage together with how its decisions are applied
+type Limiter struct {
+	Name    string // Identifies the limit in logs
+	Storage storage.Storage
+	Shadow  bool // Only record requests that would be blocked, never reject them
+}
+
+// Rule applies its own limiters to requests matching its methods and path.
+// A rule without methods and path matches every request.
+type Rule struct {
+	Name       string
+	Methods    []string
+	PathPrefix string
+	PathRegex  *regexp.Regexp
+	Key        KeyExtractor
+	Limiters   []Limiter
+	Queue      *WaitQueue    // Lets rejected requests wait for capacity, nil rejects them right away
+	Tiers      *TierResolver // Adds the limiters of the client's tier, nil when tiers are not used
+	Cost       int           // Units of quota consumed per request, zero counts as one
+}
+
+// Matches reports whether the request falls under the rule
+func (rule *Rule) Matches(r *http.Request) bool {
+	if len(rule.Methods) > 0 && !slices.Contains(rule.Methods, r.Method) {
+		return false
+	}
+	if rule.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rule.PathPrefix) {
+		return false
+	}
+	if rule.PathRegex != nil && !rule.PathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	return true
+}
+
+// limiters returns the rate limit key of the request and the limiters applying to it
+func (rule *Rule) limiters(r *http.Request) (string, []Limiter) {
+	key, _ := rule.Key.Extract(r)
+	if rule.Tiers == nil {
+		return key, rule.Limiters
+	}
+
+	// Clients with a known API key are limited by a hash of the key, whatever their IP address
+	tier, apiKey := rule.Tiers.Resolve(r)
+	if apiKey != "" {
+		key = apiKey
+	}
+	return key, append(slices.Clip(tier.Limiters), rule.Limiters...)
+}
+
+// cost returns the units of quota a request matching the rule consumes upfront
+func (rule *Rule) cost() int {
+	return max(rule.Cost, 1)
+}
+
 // RateLimitMiddleware handles rate limiting for the proxy
 type RateLimitMiddleware struct {
-	config  *config.Config
-	limiter storage.Storage
-	host    string
-	getIP   func(*http.Request) string
-	metric  *metric.Metric
+	config *config.Config
+	rules  []Rule
+	host   string
+	getIP  func(*http.Request) string
+	metric *metric.Metric
 }
 
-// NewRateLimitMiddleware creates a new rate limiting middleware
-func NewRateLimitMiddleware(cfg *config.Config, limiter storage.Storage, host string, getIP func(*http.Request) string, metric *metric.Metric) *RateLimitMiddleware {
+// NewRateLimitMiddleware creates a new rate limiting middleware, rules are matched in order
+func NewRateLimitMiddleware(cfg *config.Config, rules []Rule, host string, getIP func(*http.Request) string, metric *metric.Metric) *RateLimitMiddleware {
 	return &RateLimitMiddleware{
-		config:  cfg,
-		limiter: limiter,
-		host:    host,
-		getIP:   getIP,
-		metric:  metric,
+		config: cfg,
+		rules:  rules,
+		host:   host,
+		getIP:  getIP,
+		metric: metric,
 	}
 }
 
@@ -38,24 +99,200 @@ func (m *RateLimitMiddleware) Handle(next http.Handler) http.Handler {
 			return
 		}
 
+		// Allowlisted clients are never blocked
+		if Exempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		clientIP := m.getIP(r)
 
 		// Check IP blacklist
-		if target.IPBlackList[clientIP] {
+		if target.IPBlackList.ContainsString(clientIP) {
 			http.Error(w, fmt.Sprintf("Access denied. Your IP (%s) is blocked.", clientIP), http.StatusForbidden)
 			return
 		}
 
-		// Check rate limit
-		if m.limiter.CheckLimit(clientIP) {
+		// Check rate limit of the first matching rule
+		rule := m.match(r)
+		decision := m.decide(rule, r, clientIP)
+		if !decision.Allowed && rule.Queue != nil {
+			decision = m.wait(rule, r, decision)
+		}
+		if m.metric != nil && decision.Limit > 0 {
+			m.metric.RateLimitRemaining.WithLabelValues(m.host).Observe(float64(decision.Remaining) / float64(decision.Limit))
+		}
+
+		var quota http.Header
+		if target.Headers.Enabled {
+			quota = make(http.Header)
+			setRateLimitHeaders(quota, decision, target.Headers.Legacy)
+			for name, values := range quota {
+				w.Header()[name] = values
+			}
+		}
+
+		if !decision.Allowed {
 			// Record rate limit hit metric
 			if m.metric != nil {
 				m.metric.RateLimitHits.WithLabelValues(m.host, clientIP).Inc()
 			}
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(decision.RetryAfter)))
 			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 			return
 		}
 
+		// Quota headers sent by the backend are replaced by the proxy's
+		if len(quota) > 0 {
+			w = &quotaHeaderWriter{ResponseWriter: w, quota: quota}
+		}
+
+		// The backend may report a higher cost than the one charged upfront
+		if rule != nil && target.CostHeader != "" {
+			cw := &costWriter{ResponseWriter: w, header: target.CostHeader}
+			next.ServeHTTP(cw, r)
+			m.charge(rule, r, cw.cost)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// match returns the first rule matching the request, nil when none does
+func (m *RateLimitMiddleware) match(r *http.Request) *Rule {
+	for i := range m.rules {
+		if m.rules[i].Matches(r) {
+			return &m.rules[i]
+		}
+	}
+	return nil
+}
+
+// decide evaluates all limiters of the rule for the request key and returns the tightest enforced decision.
+// Shadow limiters only record would-be blocks, logged by client IP so keys like API keys never leak.
+func (m *RateLimitMiddleware) decide(rule *Rule, r *http.Request, clientIP string) storage.Decision {
+	if rule == nil {
+		return storage.Decision{Allowed: true, Limit: -1, Remaining: -1}
+	}
+	key, limiters := rule.limiters(r)
+	cost := rule.cost()
+
+	for _, limiter := range limiters {
+		if !limiter.Shadow {
+			continue
+		}
+
+		if d := limiter.Storage.DecideN(key, cost); !d.Allowed {
+			log.Printf("Shadow rate limit %s/%s on %s would block %s (retry after %v)", rule.Name, limiter.Name, m.host, clientIP, d.RetryAfter)
+			if m.metric != nil {
+				m.metric.RateLimitWouldBlock.WithLabelValues(m.host, rule.Name).Inc()
+			}
+		}
+	}
+
+	return commit(enforced(limiters), key, cost)
+}
+
+// enforced returns the storages of the limiters that may reject requests
+func enforced(limiters []Limiter) []storage.Storage {
+	var storages []storage.Storage
+	for _, limiter := range limiters {
+		if !limiter.Shadow {
+			storages = append(storages, limiter.Storage)
+		}
+	}
+	return storages
+}
+
+// commit charges the key to every storage if all of them allow the request. Stacked limits are
+// all checked before any of them is charged, so requests rejected by one limit, e.g. a burst
+// over the per-second limit, do not use up the quota of the others.
+func commit(storages []storage.Storage, key string, cost int) storage.Decision {
+	if len(storages) == 0 {
+		return storage.Decision{Allowed: true, Limit: -1, Remaining: -1}
+	}
+	if len(storages) > 1 {
+		if checked := peek(storages, key, cost); !checked.Allowed {
+			return checked
+		}
+	}
+
+	// A limit drained by a concurrent request between the check and the charge still rejects
+	return tightest(storages, func(s storage.Storage) storage.Decision { return s.DecideN(key, cost) })
+}
+
+// peek returns the tightest decision of the storages for the key without charging any of them
+func peek(storages []storage.Storage, key string, cost int) storage.Decision {
+	return tightest(storages, func(s storage.Storage) storage.Decision { return s.PeekN(key, cost) })
+}
+
+// tightest applies decide to every storage and reports the tightest decision: the longest
+// rejection, otherwise the least remaining quota
+func tightest(storages []storage.Storage, decide func(storage.Storage) storage.Decision) storage.Decision {
+	decision := decide(storages[0])
+	for _, s := range storages[1:] {
+		if d := decide(s); tighter(d, decision) {
+			decision = d
+		}
+	}
+	return decision
+}
+
+// charge consumes the part of the backend reported cost not taken upfront. The request has
+// already passed, so limits without enough quota left are drained instead of rejecting it.
+func (m *RateLimitMiddleware) charge(rule *Rule, r *http.Request, cost int) {
+	extra := cost - rule.cost()
+	if extra <= 0 {
+		return
+	}
+
+	key, limiters := rule.limiters(r)
+	for _, limiter := range limiters {
+		if d := limiter.Storage.DecideN(key, extra); !d.Allowed && d.Remaining > 0 {
+			limiter.Storage.DecideN(key, d.Remaining)
+		}
+	}
+}
+
+// tighter reports whether decision a constrains the client more than decision b
+func tighter(a, b storage.Decision) bool {
+	if a.Allowed != b.Allowed {
+		return !a.Allowed
+	}
+	if !a.Allowed {
+		return a.RetryAfter > b.RetryAfter
+	}
+	return a.Limit >= 0 && (b.Limit < 0 || a.Remaining < b.Remaining)
+}
+
+// setRateLimitHeaders writes the IETF RateLimit-* headers and optionally the legacy X-RateLimit-* ones
+func setRateLimitHeaders(h http.Header, decision storage.Decision, legacy bool) {
+	// Unlimited storages have no quota to report
+	if decision.Limit < 0 {
+		return
+	}
+
+	limit := strconv.Itoa(decision.Limit)
+	remaining := strconv.Itoa(decision.Remaining)
+
+	h.Set("RateLimit-Limit", limit)
+	h.Set("RateLimit-Remaining", remaining)
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(time.Until(decision.ResetAt))))
+
+	if legacy {
+		// Legacy reset is an absolute unix timestamp
+		h.Set("X-RateLimit-Limit", limit)
+		h.Set("X-RateLimit-Remaining", remaining)
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(decision.ResetAt.Unix(), 10))
+	}
+}
+
+// ceilSeconds rounds a duration up to whole seconds, at least one
+func ceilSeconds(d time.Duration) int {
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
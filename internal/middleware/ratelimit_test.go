@@ -0,0 +1,377 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/metric"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testClientIP reads the client address of test requests from X-Forwarded-For
+func testClientIP(r *http.Request) string {
+	return r.Header.Get("X-Forwarded-For")
+}
+
+// newTestHandler returns the middleware of example.com with the given host config and rules in front of next
+func newTestHandler(target config.RateLimitConfig, rules []Rule, next http.HandlerFunc) http.Handler {
+	cfg := &config.Config{RateLimits: map[string]config.RateLimitConfig{"example.com": target}}
+	return NewRateLimitMiddleware(cfg, rules, "example.com", testClientIP, nil).Handle(next)
+}
+
+// hostRule returns a rule matching every request, keyed by client IP, with the given limiters
+func hostRule(limiters ...Limiter) Rule {
+	key, _ := NewKeyExtractor("", testClientIP)
+	return Rule{Name: "host", Key: key, Limiters: limiters}
+}
+
+// serveTest sends a request of the client to the handler
+func serveTest(handler http.Handler, method, target, client string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://example.com"+target, nil)
+	req.Header.Set("X-Forwarded-For", client)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// serveAPIKey sends a request of client 192.168.1.1 with the API key to the handler
+func serveAPIKey(handler http.Handler, apiKey string) int {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("X-Forwarded-For", "192.168.1.1")
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// ok is a backend answering every request with 200
+func ok(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestTighter(t *testing.T) {
+	unlimited := storage.Decision{Allowed: true, Limit: -1, Remaining: -1}
+	perSecond := storage.Decision{Allowed: true, Limit: 10, Remaining: 9}
+	perMonth := storage.Decision{Allowed: true, Limit: 100000, Remaining: 3}
+	shortBlock := storage.Decision{Limit: 10, RetryAfter: time.Second}
+	longBlock := storage.Decision{Limit: 100000, RetryAfter: 24 * time.Hour}
+
+	tests := []struct {
+		name string
+		a, b storage.Decision
+		want bool
+	}{
+		{"rejection beats allowance", shortBlock, perMonth, true},
+		{"allowance never beats rejection", perMonth, shortBlock, false},
+		{"longer rejection wins", longBlock, shortBlock, true},
+		{"shorter rejection loses", shortBlock, longBlock, false},
+		{"less remaining wins", perMonth, perSecond, true},
+		{"more remaining loses", perSecond, perMonth, false},
+		{"limited beats unlimited", perSecond, unlimited, true},
+		{"unlimited never wins", unlimited, perSecond, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tighter(tt.a, tt.b); got != tt.want {
+				t.Errorf("tighter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware_Headers(t *testing.T) {
+	tests := []struct {
+		name   string
+		legacy bool
+		want   map[string]string // Expected headers, empty value means absent
+	}{
+		{"ietf only", false, map[string]string{
+			"RateLimit-Limit":     "2",
+			"RateLimit-Remaining": "1",
+			"RateLimit-Reset":     "60",
+			"X-RateLimit-Limit":   "",
+		}},
+		{"with legacy", true, map[string]string{
+			"RateLimit-Limit":       "2",
+			"X-RateLimit-Limit":     "2",
+			"X-RateLimit-Remaining": "1",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := storage.NewIPRateLimiter(60, 2)
+			defer limiter.Close()
+
+			target := config.RateLimitConfig{Headers: config.RateLimitHeaders{Enabled: true, Legacy: tt.legacy}}
+			handler := newTestHandler(target, []Rule{hostRule(Limiter{Name: "default", Storage: limiter})}, ok)
+
+			start := time.Now()
+			rec := serveTest(handler, http.MethodGet, "/", "192.168.1.1")
+			for name, want := range tt.want {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+
+			// Legacy reset is the unix time the window ends
+			if tt.legacy {
+				reset, _ := strconv.ParseInt(rec.Header().Get("X-RateLimit-Reset"), 10, 64)
+				if end := start.Add(time.Minute).Unix(); reset < end || reset > end+1 {
+					t.Errorf("X-RateLimit-Reset = %d, want %d", reset, end)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware_HeadersUnlimited(t *testing.T) {
+	target := config.RateLimitConfig{Headers: config.RateLimitHeaders{Enabled: true, Legacy: true}}
+	handler := newTestHandler(target, []Rule{hostRule(Limiter{Name: "default", Storage: storage.NewFakeStorage()})}, ok)
+
+	rec := serveTest(handler, http.MethodGet, "/", "192.168.1.1")
+	for _, name := range []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "X-RateLimit-Limit"} {
+		if value := rec.Header().Get(name); value != "" {
+			t.Errorf("Unlimited host should not send %s, got %q", name, value)
+		}
+	}
+}
+
+func TestRateLimitMiddleware_RetryAfter(t *testing.T) {
+	limiter := storage.NewIPRateLimiter(60, 1)
+	defer limiter.Close()
+
+	// Retry-After is sent on rejections even without quota headers
+	handler := newTestHandler(config.RateLimitConfig{}, []Rule{hostRule(Limiter{Name: "default", Storage: limiter})}, ok)
+
+	if rec := serveTest(handler, http.MethodGet, "/", "192.168.1.1"); rec.Header().Get("Retry-After") != "" {
+		t.Errorf("Allowed request should not carry Retry-After, got %q", rec.Header().Get("Retry-After"))
+	}
+
+	rec := serveTest(handler, http.MethodGet, "/", "192.168.1.1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+}
+
+func TestRateLimitMiddleware_BackendQuotaHeaders(t *testing.T) {
+	limiter := storage.NewIPRateLimiter(60, 10)
+	defer limiter.Close()
+
+	// The backend reports its own quota the way a reverse proxy copies it, by appending
+	backend := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("RateLimit-Limit", "1000")
+		w.Header().Add("RateLimit-Remaining", "999")
+		w.Header().Add("X-Backend", "kept")
+		w.WriteHeader(http.StatusOK)
+	}
+	target := config.RateLimitConfig{Headers: config.RateLimitHeaders{Enabled: true}}
+	handler := newTestHandler(target, []Rule{hostRule(Limiter{Name: "default", Storage: limiter})}, backend)
+
+	rec := serveTest(handler, http.MethodGet, "/", "192.168.1.1")
+	if got := rec.Header().Values("RateLimit-Limit"); len(got) != 1 || got[0] != "10" {
+		t.Errorf("RateLimit-Limit = %v, want [10]", got)
+	}
+	if got := rec.Header().Values("RateLimit-Remaining"); len(got) != 1 || got[0] != "9" {
+		t.Errorf("RateLimit-Remaining = %v, want [9]", got)
+	}
+	if got := rec.Header().Get("X-Backend"); got != "kept" {
+		t.Errorf("Other backend headers should pass, X-Backend = %q", got)
+	}
+}
+
+func TestCeilSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int
+	}{
+		{-time.Second, 1},
+		{0, 1},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{time.Second + time.Millisecond, 2},
+		{59*time.Second + 999*time.Millisecond, 60},
+	}
+
+	for _, tt := range tests {
+		if got := ceilSeconds(tt.d); got != tt.want {
+			t.Errorf("ceilSeconds(%v) = %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitMiddleware_Shadow(t *testing.T) {
+	m := metric.NewMetric()
+
+	tests := []struct {
+		name     string
+		limiters func() []Limiter
+		want     []int // Status codes of consecutive requests
+		blocked  float64
+	}{
+		{"shadow limit never blocks", func() []Limiter {
+			return []Limiter{{Name: "shadow", Storage: storage.NewIPRateLimiter(60, 1), Shadow: true}}
+		}, []int{200, 200, 200}, 2},
+		{"shadow limit next to an enforced one", func() []Limiter {
+			return []Limiter{
+				{Name: "default", Storage: storage.NewIPRateLimiter(60, 3)},
+				{Name: "shadow", Storage: storage.NewIPRateLimiter(60, 1), Shadow: true},
+			}
+		}, []int{200, 200, 200, 429}, 3},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiters := tt.limiters()
+			for _, l := range limiters {
+				defer l.Storage.Close()
+			}
+			client := "192.168.1." + strconv.Itoa(i+1)
+			cfg := &config.Config{RateLimits: map[string]config.RateLimitConfig{"example.com": {}}}
+			handler := NewRateLimitMiddleware(cfg, []Rule{hostRule(limiters...)}, "example.com", testClientIP, m).Handle(http.HandlerFunc(ok))
+			blocked := m.RateLimitWouldBlock.WithLabelValues("example.com", "host")
+			before := testutil.ToFloat64(blocked)
+
+			for j, want := range tt.want {
+				if code := serveTest(handler, http.MethodGet, "/", client).Code; code != want {
+					t.Errorf("Request %d: got %d, want %d", j+1, code, want)
+				}
+			}
+			if got := testutil.ToFloat64(blocked) - before; got != tt.blocked {
+				t.Errorf("rlsp_rate_limit_would_block_total = %v, want %v", got, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestRule_Matches(t *testing.T) {
+	tests := []struct {
+		name         string
+		rule         Rule
+		method, path string
+		want         bool
+	}{
+		{"empty rule matches all", Rule{}, http.MethodDelete, "/anything", true},
+		{"method matches", Rule{Methods: []string{http.MethodPost, http.MethodPut}}, http.MethodPut, "/", true},
+		{"method differs", Rule{Methods: []string{http.MethodPost}}, http.MethodGet, "/", false},
+		{"prefix matches", Rule{PathPrefix: "/api/"}, http.MethodGet, "/api/users", true},
+		{"prefix differs", Rule{PathPrefix: "/api/"}, http.MethodGet, "/apix", false},
+		{"regex matches", Rule{PathRegex: regexp.MustCompile(`^/users/\d+$`)}, http.MethodGet, "/users/42", true},
+		{"regex differs", Rule{PathRegex: regexp.MustCompile(`^/users/\d+$`)}, http.MethodGet, "/users/me", false},
+		{"all conditions match", Rule{Methods: []string{http.MethodPost}, PathPrefix: "/api/", PathRegex: regexp.MustCompile(`/login$`)}, http.MethodPost, "/api/login", true},
+		{"one condition differs", Rule{Methods: []string{http.MethodPost}, PathPrefix: "/api/", PathRegex: regexp.MustCompile(`/login$`)}, http.MethodGet, "/api/login", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://example.com"+tt.path, nil)
+			if got := tt.rule.Matches(r); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware_Match(t *testing.T) {
+	rules := []Rule{
+		{Name: "login", Methods: []string{http.MethodPost}, PathPrefix: "/api/login"},
+		{Name: "api", PathPrefix: "/api/"},
+		{Name: "search", PathRegex: regexp.MustCompile(`^/api/search`)}, // Shadowed by api
+		{Name: "host"},
+	}
+	m := NewRateLimitMiddleware(&config.Config{}, rules, "example.com", testClientIP, nil)
+
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		{http.MethodPost, "/api/login", "login"},
+		{http.MethodGet, "/api/login", "api"},
+		{http.MethodGet, "/api/search", "api"},
+		{http.MethodGet, "/", "host"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://example.com"+tt.path, nil)
+		if got := m.match(r); got == nil || got.Name != tt.want {
+			t.Errorf("%s %s matched %v, want %s", tt.method, tt.path, got, tt.want)
+		}
+	}
+
+	// Without a catch-all rule unmatched requests are not limited
+	m = NewRateLimitMiddleware(&config.Config{}, rules[:1], "example.com", testClientIP, nil)
+	if got := m.match(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); got != nil {
+		t.Errorf("Expected no rule, got %s", got.Name)
+	}
+}
+
+func TestRateLimitMiddleware_RuleLimits(t *testing.T) {
+	login := storage.NewIPRateLimiter(60, 1)
+	defer login.Close()
+	host := storage.NewIPRateLimiter(60, 3)
+	defer host.Close()
+
+	key, _ := NewKeyExtractor("", testClientIP)
+	rules := []Rule{
+		{Name: "login", Methods: []string{http.MethodPost}, PathPrefix: "/login", Key: key, Limiters: []Limiter{{Name: "default", Storage: login}}},
+		hostRule(Limiter{Name: "default", Storage: host}),
+	}
+	handler := newTestHandler(config.RateLimitConfig{}, rules, ok)
+
+	// Each rule counts only the requests it matched
+	steps := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodPost, "/login", 200},
+		{http.MethodPost, "/login", 429},
+		{http.MethodGet, "/login", 200},
+		{http.MethodGet, "/", 200},
+		{http.MethodGet, "/", 200},
+		{http.MethodGet, "/", 429},
+	}
+	for i, s := range steps {
+		if code := serveTest(handler, s.method, s.path, "192.168.1.1").Code; code != s.want {
+			t.Errorf("Step %d %s %s: got %d, want %d", i+1, s.method, s.path, code, s.want)
+		}
+	}
+}
+
+func TestRateLimitMiddleware_StackedLimits(t *testing.T) {
+	perSecond := storage.NewIPRateLimiter(1, 2)
+	defer perSecond.Close()
+	perDay := storage.NewCalendarLimiter(storage.CalendarDay, time.UTC, 100)
+	defer perDay.Close()
+
+	handler := newTestHandler(config.RateLimitConfig{}, []Rule{hostRule(
+		Limiter{Name: "second", Storage: perSecond},
+		Limiter{Name: "day", Storage: perDay},
+	)}, ok)
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if serveTest(handler, http.MethodGet, "/", "192.168.1.1").Code == http.StatusOK {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Fatalf("Expected 2 requests within the per-second limit, got %d", allowed)
+	}
+
+	// Requests rejected by the per-second limit leave the daily quota untouched
+	if d := perDay.PeekN("192.168.1.1", 100-allowed); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("Expected %d remaining requests of the day, got %+v", 100-allowed, d)
+	}
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// Tier is a client plan with its own limiters
+type Tier struct {
+	Name     string
+	Limiters []Limiter
+}
+
+// TierResolver maps the API key of a request to the tier of its plan
+type TierResolver struct {
+	header    string            // Header carrying the API key
+	keys      map[string]string // API key -> tier name
+	tiers     map[string]*Tier  // Tier name -> tier
+	anonymous *Tier             // Tier of requests without a known API key
+}
+
+// NewTierResolver creates a resolver reading API keys from header, keys maps API keys to tier names
+func NewTierResolver(header string, keys map[string]string, tiers map[string]*Tier, anonymous string) *TierResolver {
+	return &TierResolver{
+		header:    header,
+		keys:      keys,
+		tiers:     tiers,
+		anonymous: tiers[anonymous],
+	}
+}
+
+// Resolve returns the tier of the request and the rate limit key of its API key, requests
+// without a known API key get the anonymous tier and no key
+func (t *TierResolver) Resolve(r *http.Request) (*Tier, string) {
+	apiKey := r.Header.Get(t.header)
+	if apiKey != "" {
+		if tier, ok := t.tiers[t.keys[apiKey]]; ok {
+			return tier, hashAPIKey(apiKey)
+		}
+	}
+	return t.anonymous, ""
+}
+
+// Tiers returns all tiers by name
+func (t *TierResolver) Tiers() map[string]*Tier {
+	return t.tiers
+}
+
+// hashAPIKey returns the rate limit key of an API key. Keys end up in Redis, gossip
+// messages and snapshots, so only a hash of the secret is used.
+func hashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
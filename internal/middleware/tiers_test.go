@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/storage"
+)
+
+func TestTierResolver_Resolve(t *testing.T) {
+	free := &Tier{Name: "free"}
+	pro := &Tier{Name: "pro"}
+	resolver := NewTierResolver("X-API-Key",
+		map[string]string{"key-pro": "pro", "key-missing": "gold"},
+		map[string]*Tier{"free": free, "pro": pro},
+		"free",
+	)
+
+	tests := []struct {
+		name     string
+		apiKey   string
+		wantTier *Tier
+		wantKey  string
+	}{
+		{"known key", "key-pro", pro, hashAPIKey("key-pro")},
+		{"no key", "", free, ""},
+		{"unknown key", "key-unknown", free, ""},
+		{"key of an unknown tier", "key-missing", free, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.apiKey != "" {
+				r.Header.Set("X-API-Key", tt.apiKey)
+			}
+			tier, key := resolver.Resolve(r)
+			if tier != tt.wantTier || key != tt.wantKey {
+				t.Errorf("Resolve() = %v, %q, want %v, %q", tier.Name, key, tt.wantTier.Name, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestHashAPIKey(t *testing.T) {
+	key := hashAPIKey("key-pro")
+	if key == hashAPIKey("key-free") {
+		t.Error("Expected distinct API keys to have distinct rate limit keys")
+	}
+	if strings.Contains(key, "key-pro") || len(key) != 64 {
+		t.Errorf("Expected a hex SHA-256 hash, got %q", key)
+	}
+}
+
+func TestRateLimitMiddleware_Tiers(t *testing.T) {
+	free := storage.NewIPRateLimiter(60, 1)
+	defer free.Close()
+	pro := storage.NewIPRateLimiter(60, 3)
+	defer pro.Close()
+
+	rule := hostRule()
+	rule.Tiers = NewTierResolver("X-API-Key",
+		map[string]string{"key-free-1": "free", "key-free-2": "free", "key-pro": "pro"},
+		map[string]*Tier{
+			"free": {Name: "free", Limiters: []Limiter{{Name: "free", Storage: free}}},
+			"pro":  {Name: "pro", Limiters: []Limiter{{Name: "pro", Storage: pro}}},
+		},
+		"free",
+	)
+	handler := newTestHandler(config.RateLimitConfig{}, []Rule{rule}, ok)
+
+	// Every API key has the limit of its tier, requests without one are limited by IP address
+	requests := []struct {
+		apiKey string
+		want   int
+	}{
+		{"key-pro", http.StatusOK},
+		{"key-pro", http.StatusOK},
+		{"key-pro", http.StatusOK},
+		{"key-pro", http.StatusTooManyRequests},
+		{"key-free-1", http.StatusOK},
+		{"key-free-1", http.StatusTooManyRequests},
+		{"key-free-2", http.StatusOK},
+		{"", http.StatusOK},
+		{"", http.StatusTooManyRequests},
+		{"key-unknown", http.StatusTooManyRequests},
+	}
+	for i, req := range requests {
+		if code := serveAPIKey(handler, req.apiKey); code != req.want {
+			t.Errorf("Request %d with key %q: got %d, want %d", i+1, req.apiKey, code, req.want)
+		}
+	}
+
+	// Limits are kept under a hash of the API key, never the key itself
+	if free.PeekN(hashAPIKey("key-free-1"), 1).Allowed {
+		t.Error("Expected the limit of key-free-1 to be kept under its hash")
+	}
+	if !free.PeekN("key-free-1", 1).Allowed {
+		t.Error("Expected no limit to be kept under the raw API key")
+	}
+}
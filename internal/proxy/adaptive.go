@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// adaptiveLimit moves the limit of a host between its bounds following backend health (AIMD):
+// every interval with slow or failing responses multiplies the limit by the decrease factor,
+// every healthy interval adds the increase back
+type adaptiveLimit struct {
+	mu       sync.Mutex
+	host     string
+	cfg      *config.AdaptiveConfig
+	limiter  *storage.SlidingWindowLimiter
+	limit    int           // Current effective limit
+	requests int           // Responses observed in the current interval
+	errors   int           // 5xx responses among them
+	latency  time.Duration // Summed response time of the interval
+	gauge    prometheus.Gauge
+	done     chan struct{}
+}
+
+// newAdaptiveLimit creates an adaptive limit starting at its upper bound and adjusting it periodically
+func newAdaptiveLimit(host string, cfg *config.AdaptiveConfig, gauge prometheus.Gauge) *adaptiveLimit {
+	a := &adaptiveLimit{
+		host:    host,
+		cfg:     cfg,
+		limiter: storage.NewSlidingWindowLimiter(cfg.PerSecond, cfg.MaxRequests),
+		limit:   cfg.MaxRequests,
+		gauge:   gauge,
+		done:    make(chan struct{}),
+	}
+	gauge.Set(float64(a.limit))
+
+	go a.adjustRoutine()
+
+	return a
+}
+
+// observe records a proxied response of the host
+func (a *adaptiveLimit) observe(duration time.Duration, statusCode int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.requests++
+	a.latency += duration
+	if statusCode >= http.StatusInternalServerError {
+		a.errors++
+	}
+}
+
+// adjustRoutine adjusts the limit once per interval
+func (a *adaptiveLimit) adjustRoutine() {
+	ticker := time.NewTicker(a.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.adjust()
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// adjust lowers the limit when the backend degraded during the last interval, otherwise raises it
+func (a *adaptiveLimit) adjust() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	degraded := false
+	if a.requests > 0 {
+		slow := a.cfg.Latency > 0 && a.latency/time.Duration(a.requests) > a.cfg.Latency
+		failing := float64(a.errors)/float64(a.requests) > a.cfg.ErrorRate
+		degraded = slow || failing
+	}
+
+	limit := min(a.limit+a.cfg.Increase, a.cfg.MaxRequests)
+	if degraded {
+		limit = max(int(float64(a.limit)*a.cfg.Decrease), a.cfg.MinRequests)
+		if limit < a.limit {
+			log.Printf("Host %s backend degraded (%d responses, %d errors), lowering limit to %d", a.host, a.requests, a.errors, limit)
+		}
+	}
+
+	a.requests, a.errors, a.latency = 0, 0, 0
+	if limit != a.limit {
+		a.limit = limit
+		a.limiter.SetLimit(limit)
+		a.gauge.Set(float64(limit))
+	}
+}
+
+// storage returns the limiter charging every request of the host on one host-wide key
+func (a *adaptiveLimit) storage() storage.Storage {
+	return hostStorage{a}
+}
+
+// Close stops adjusting the limit and closes its limiter
+func (a *adaptiveLimit) Close() {
+	close(a.done)
+	a.limiter.Close()
+}
+
+// hostStorage counts the requests of all clients of a host together, it is shared by every rule
+// of the host and closed with the adaptive limit
+type hostStorage struct {
+	a *adaptiveLimit
+}
+
+func (s hostStorage) DecideN(_ string, n int) storage.Decision {
+	return s.a.limiter.DecideN(s.a.host, n)
+}
+
+func (s hostStorage) PeekN(_ string, n int) storage.Decision {
+	return s.a.limiter.PeekN(s.a.host, n)
+}
+
+func (s hostStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAdaptiveLimit_Adjust(t *testing.T) {
+	cfg := &config.AdaptiveConfig{
+		MinRequests: 10,
+		MaxRequests: 100,
+		PerSecond:   60,
+		Latency:     100 * time.Millisecond,
+		ErrorRate:   0.1,
+		Interval:    time.Hour, // Adjusted by hand below
+		Increase:    20,
+		Decrease:    0.5,
+	}
+	a := newAdaptiveLimit("example.com", cfg, prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_effective_limit"}))
+	defer a.Close()
+
+	steps := []struct {
+		name      string
+		responses []int // Status codes observed during the interval
+		latency   time.Duration
+		want      int
+	}{
+		{"healthy stays at the upper bound", []int{200, 200}, 10 * time.Millisecond, 100},
+		{"errors halve the limit", []int{200, 500}, 10 * time.Millisecond, 50},
+		{"slow responses halve the limit", []int{200}, 200 * time.Millisecond, 25},
+		{"repeated failures keep lowering", []int{502}, 0, 12},
+		{"limit never drops below the lower bound", []int{502}, 0, 10},
+		{"healthy interval adds the increase", []int{200}, 10 * time.Millisecond, 30},
+		{"idle interval counts as healthy", nil, 0, 50},
+	}
+
+	for _, step := range steps {
+		for _, code := range step.responses {
+			a.observe(step.latency, code)
+		}
+		a.adjust()
+		if a.limit != step.want {
+			t.Errorf("%s: expected limit %d, got %d", step.name, step.want, a.limit)
+		}
+	}
+
+	// The limiter enforces the effective limit
+	for i := 0; i < 50; i++ {
+		a.limiter.DecideN("192.168.1.1", 1)
+	}
+	if d := a.limiter.DecideN("192.168.1.1", 1); d.Allowed || d.Limit != 50 {
+		t.Errorf("Expected rejection at the effective limit, got %+v", d)
+	}
+}
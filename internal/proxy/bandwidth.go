@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/middleware"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// hostBandwidth throttles the bytes transferred by a host, per key and in total
+type hostBandwidth struct {
+	perKey *storage.TokenBucketLimiter // nil when keys are not limited
+	host   *storage.TokenBucketLimiter // nil when the host is not limited
+	key    middleware.KeyExtractor
+	chunk  int                                              // Largest number of bytes reserved at once, the smallest burst
+	sleep  func(ctx context.Context, d time.Duration) error // Waits for d unless ctx is done, replaceable in tests
+}
+
+// newHostBandwidth creates the byte rate limiters of a host, tokens are bytes
+func newHostBandwidth(cfg *config.BandwidthConfig, key middleware.KeyExtractor) *hostBandwidth {
+	b := &hostBandwidth{key: key, sleep: sleepContext}
+	if cfg.PerKey != nil {
+		b.perKey = storage.NewTokenBucketLimiter(cfg.PerKey.Burst, float64(cfg.PerKey.Rate))
+		b.chunk = cfg.PerKey.Burst
+	}
+	if cfg.Host != nil {
+		b.host = storage.NewTokenBucketLimiter(cfg.Host.Burst, float64(cfg.Host.Rate))
+		if b.chunk == 0 || cfg.Host.Burst < b.chunk {
+			b.chunk = cfg.Host.Burst
+		}
+	}
+	return b
+}
+
+// Close stops the cleanup of the byte rate limiters
+func (b *hostBandwidth) Close() {
+	if b.perKey != nil {
+		b.perKey.Close()
+	}
+	if b.host != nil {
+		b.host.Close()
+	}
+}
+
+// throttle paces the bytes of a single request in one direction
+type throttle struct {
+	ctx       context.Context
+	bandwidth *hostBandwidth
+	key       string
+	throttled prometheus.Counter
+}
+
+// newThrottle creates a throttle for the request, direction labels the throttled bytes metric
+func (b *hostBandwidth) newThrottle(r *http.Request, throttled prometheus.Counter) *throttle {
+	key, _ := b.key.Extract(r)
+	return &throttle{ctx: r.Context(), bandwidth: b, key: key, throttled: throttled}
+}
+
+// wait blocks until n bytes may be transferred or the request is cancelled
+func (t *throttle) wait(n int) error {
+	var delay time.Duration
+	if t.bandwidth.perKey != nil {
+		delay = t.bandwidth.perKey.Reserve(t.key, n)
+	}
+	if t.bandwidth.host != nil {
+		delay = max(delay, t.bandwidth.host.Reserve("", n))
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	t.throttled.Add(float64(n))
+	return t.bandwidth.sleep(t.ctx, delay)
+}
+
+// sleepContext waits for d, returning the error of ctx early when it is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// write passes data to w in chunks no larger than the burst, waiting before each chunk
+func (t *throttle) write(w io.Writer, data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		chunk := data[written:min(len(data), written+t.bandwidth.chunk)]
+		if err := t.wait(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// throttledBody paces reads of a request body
+type throttledBody struct {
+	io.ReadCloser
+	throttle *throttle
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > b.throttle.bandwidth.chunk {
+		p = p[:b.throttle.bandwidth.chunk]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := b.throttle.wait(n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
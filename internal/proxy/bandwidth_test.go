@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeClock is a manually advanced clock for deterministic throttling tests
+type fakeClock struct {
+	t time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+// newTestBandwidth creates the bandwidth limits of a host keyed by X-Client on a fake clock.
+// Waits advance the clock instead of sleeping and are recorded in the returned slice.
+func newTestBandwidth(t *testing.T, cfg *config.BandwidthConfig) (*hostBandwidth, *[]time.Duration) {
+	t.Helper()
+
+	key, err := middleware.NewKeyExtractor("header:X-Client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newHostBandwidth(cfg, key)
+	t.Cleanup(b.Close)
+
+	clock := newFakeClock()
+	if b.perKey != nil {
+		b.perKey.SetClock(clock.Now)
+	}
+	if b.host != nil {
+		b.host.SetClock(clock.Now)
+	}
+
+	var waits []time.Duration
+	b.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		clock.Advance(d)
+		return ctx.Err()
+	}
+	return b, &waits
+}
+
+// newTestThrottle creates a throttle for a request of the client
+func newTestThrottle(b *hostBandwidth, ctx context.Context, client string) (*throttle, prometheus.Counter) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	r.Header.Set("X-Client", client)
+	throttled := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_throttled_bytes"})
+	return b.newThrottle(r, throttled), throttled
+}
+
+// chunkWriter records the size of every write
+type chunkWriter struct {
+	bytes.Buffer
+	chunks []int
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.chunks = append(w.chunks, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestThrottle_Write(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        config.BandwidthConfig
+		size       int
+		wantChunks []int
+		wantWaits  []time.Duration
+		throttled  int // Bytes that had to wait
+	}{
+		{
+			name:       "within burst",
+			cfg:        config.BandwidthConfig{PerKey: &config.ByteRate{Rate: 4, Burst: 4}},
+			size:       4,
+			wantChunks: []int{4},
+		},
+		{
+			name:       "per key rate",
+			cfg:        config.BandwidthConfig{PerKey: &config.ByteRate{Rate: 4, Burst: 4}},
+			size:       10,
+			wantChunks: []int{4, 4, 2},
+			wantWaits:  []time.Duration{time.Second, 500 * time.Millisecond},
+			throttled:  6,
+		},
+		{
+			name:       "host rate",
+			cfg:        config.BandwidthConfig{Host: &config.ByteRate{Rate: 2, Burst: 4}},
+			size:       8,
+			wantChunks: []int{4, 4},
+			wantWaits:  []time.Duration{2 * time.Second},
+			throttled:  4,
+		},
+		{
+			// Chunks follow the smaller burst, every chunk waits for the slower limit
+			name:       "longest delay of both limits",
+			cfg:        config.BandwidthConfig{PerKey: &config.ByteRate{Rate: 4, Burst: 4}, Host: &config.ByteRate{Rate: 1, Burst: 8}},
+			size:       10,
+			wantChunks: []int{4, 4, 2},
+			wantWaits:  []time.Duration{time.Second, time.Second},
+			throttled:  6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, waits := newTestBandwidth(t, &tt.cfg)
+			th, throttled := newTestThrottle(b, context.Background(), "a")
+
+			data := bytes.Repeat([]byte("x"), tt.size)
+			w := &chunkWriter{}
+			n, err := th.write(w, data)
+			if err != nil || n != tt.size || !bytes.Equal(w.Bytes(), data) {
+				t.Fatalf("write() = %d, %v, want %d, nil", n, err, tt.size)
+			}
+			if !slices.Equal(w.chunks, tt.wantChunks) {
+				t.Errorf("Chunks = %v, want %v", w.chunks, tt.wantChunks)
+			}
+			if !slices.Equal(*waits, tt.wantWaits) {
+				t.Errorf("Waits = %v, want %v", *waits, tt.wantWaits)
+			}
+
+			if got := testutil.ToFloat64(throttled); got != float64(tt.throttled) {
+				t.Errorf("Throttled bytes = %v, want %d", got, tt.throttled)
+			}
+		})
+	}
+}
+
+func TestThrottle_Keys(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       config.BandwidthConfig
+		wantWaits []time.Duration // Waits of client b after client a used its burst
+	}{
+		{"per key limits are independent", config.BandwidthConfig{PerKey: &config.ByteRate{Rate: 4, Burst: 4}}, nil},
+		{"host limit is shared", config.BandwidthConfig{Host: &config.ByteRate{Rate: 4, Burst: 4}}, []time.Duration{time.Second}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, waits := newTestBandwidth(t, &tt.cfg)
+			a, _ := newTestThrottle(b, context.Background(), "a")
+			other, _ := newTestThrottle(b, context.Background(), "b")
+
+			if err := a.wait(4); err != nil {
+				t.Fatal(err)
+			}
+			*waits = nil
+			if err := other.wait(4); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(*waits, tt.wantWaits) {
+				t.Errorf("Waits = %v, want %v", *waits, tt.wantWaits)
+			}
+		})
+	}
+}
+
+func TestThrottledBody_Read(t *testing.T) {
+	b, waits := newTestBandwidth(t, &config.BandwidthConfig{PerKey: &config.ByteRate{Rate: 4, Burst: 4}})
+	th, _ := newTestThrottle(b, context.Background(), "a")
+	body := &throttledBody{ReadCloser: io.NopCloser(strings.NewReader("0123456789")), throttle: th}
+
+	// Reads are cut to the burst whatever the size of the buffer
+	buf := make([]byte, 64)
+	var reads []int
+	var got []byte
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			reads = append(reads, n)
+			got = append(got, buf[:n]...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if string(got) != "0123456789" {
+		t.Errorf("Read %q, want the whole body", got)
+	}
+	if want := []int{4, 4, 2}; !slices.Equal(reads, want) {
+		t.Errorf("Reads = %v, want %v", reads, want)
+	}
+	if want := []time.Duration{time.Second, 500 * time.Millisecond}; !slices.Equal(*waits, want) {
+		t.Errorf("Waits = %v, want %v", *waits, want)
+	}
+}
+
+func TestThrottle_Cancelled(t *testing.T) {
+	b, _ := newTestBandwidth(t, &config.BandwidthConfig{PerKey: &config.ByteRate{Rate: 1, Burst: 4}})
+	b.sleep = sleepContext
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	th, _ := newTestThrottle(b, ctx, "a")
+
+	// The first chunk fits the burst, the second would wait 4s but the client is gone
+	w := &chunkWriter{}
+	start := time.Now()
+	n, err := th.write(w, bytes.Repeat([]byte("x"), 8))
+	if err != context.Canceled || n != 4 {
+		t.Errorf("write() = %d, %v, want 4, %v", n, err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Cancelled write waited %v", elapsed)
+	}
+
+	body := &throttledBody{ReadCloser: io.NopCloser(strings.NewReader("0123")), throttle: th}
+	if n, err := body.Read(make([]byte, 4)); err != context.Canceled || n != 4 {
+		t.Errorf("Read() = %d, %v, want 4, %v", n, err, context.Canceled)
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strings"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/clientip"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
+)
+
+// setForwardedHeaders sets the forwarding headers of an upstream request in the format chosen by
+// the host. ReverseProxy strips the inbound ones first, X-Forwarded-For hops are only passed on
+// when they were added by a trusted proxy.
+func (p *Proxy) setForwardedHeaders(pr *httputil.ProxyRequest) {
+	mode := p.config.RateLimits[p.normalizeDomain(pr.In.Host)].ForwardedHeaders
+
+	if mode != config.ForwardedRFC7239 {
+		var hops []string
+		if peer, ok := clientip.ParseAddr(pr.In.RemoteAddr); ok && p.clientIP.Trusted(peer) {
+			for _, value := range pr.In.Header.Values("X-Forwarded-For") {
+				for _, hop := range strings.Split(value, ",") {
+					hops = append(hops, strings.TrimSpace(hop))
+				}
+			}
+
+			// The client may have been resolved from another header, e.g. X-Real-IP
+			if client := p.getClientIp(pr.In); client != peer.String() && !slices.Contains(hops, client) {
+				hops = append(hops, client)
+			}
+		}
+		if len(hops) > 0 {
+			pr.Out.Header.Set("X-Forwarded-For", strings.Join(hops, ", "))
+		}
+		pr.SetXForwarded()
+	}
+
+	if mode == config.ForwardedRFC7239 || mode == config.ForwardedBoth {
+		setForwarded(pr.Out, p.getClientIp(pr.In))
+	}
+}
+
+// setForwarded replaces the RFC 7239 Forwarded header of an upstream request with the client,
+// protocol and host seen by the proxy. Inbound values are dropped, clients may have spoofed them.
+func setForwarded(req *http.Request, clientIP string) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("Forwarded", "for="+clientip.FormatNode(clientIP)+";proto="+proto+";host="+clientip.FormatValue(req.Host))
+}
@@ -10,10 +10,13 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/JaLe29/ratelimit-simple-proxy/internal/auth"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/clientip"
 	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
 	"github.com/JaLe29/ratelimit-simple-proxy/internal/metric"
 	"github.com/JaLe29/ratelimit-simple-proxy/internal/middleware"
@@ -24,7 +27,15 @@ import (
 // Proxy represents the reverse proxy
 type Proxy struct {
 	config        *config.Config
-	limiters      map[string]storage.Storage
+	clientIP      *clientip.Resolver
+	rules         map[string][]middleware.Rule
+	redis         *storage.RedisClient           // Shared by all limiters using the redis backend
+	cluster       *storage.Cluster               // Shared by all limiters using the gossip backend
+	snapshots     map[string]storage.Snapshotter // Limiters persisted across restarts, by name
+	concurrency   map[string]*hostConcurrency    // In-flight request caps, by host
+	bandwidth     map[string]*hostBandwidth      // Byte rate caps, by host
+	adaptive      map[string]*adaptiveLimit      // Limits following backend health, by host
+	persistDone   chan struct{}
 	metric        *metric.Metric
 	auth          *auth.GoogleAuthenticator
 	loginTemplate *template.Template
@@ -34,6 +45,12 @@ type Proxy struct {
 	handlerMutex  sync.RWMutex
 }
 
+// hostConcurrency caps the in-flight requests of a host, per key and in total
+type hostConcurrency struct {
+	limiter *storage.ConcurrencyLimiter
+	key     middleware.KeyExtractor
+}
+
 // responseTimeWriter wraps http.ResponseWriter to track response time and status code
 type responseTimeWriter struct {
 	http.ResponseWriter
@@ -42,6 +59,8 @@ type responseTimeWriter struct {
 	origin     string
 	recorded   bool
 	statusCode int
+	throttle   *throttle      // Paces the response body, nil when bandwidth is not limited
+	adaptive   *adaptiveLimit // Learns backend health from responses, nil when the limit is not adaptive
 }
 
 func (w *responseTimeWriter) WriteHeader(statusCode int) {
@@ -50,6 +69,9 @@ func (w *responseTimeWriter) WriteHeader(statusCode int) {
 }
 
 func (w *responseTimeWriter) Write(data []byte) (int, error) {
+	if w.throttle != nil {
+		return w.throttle.write(w.ResponseWriter, data)
+	}
 	return w.ResponseWriter.Write(data)
 }
 
@@ -62,8 +84,8 @@ func (w *responseTimeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 
 func (w *responseTimeWriter) recordResponseTime() {
 	if !w.recorded {
-		duration := time.Since(w.startTime).Seconds()
-		w.metric.ResponseTime.WithLabelValues(w.origin).Observe(duration)
+		duration := time.Since(w.startTime)
+		w.metric.ResponseTime.WithLabelValues(w.origin).Observe(duration.Seconds())
 
 		// Record status code metric (default to 200 if WriteHeader wasn't called)
 		statusCode := w.statusCode
@@ -72,28 +94,18 @@ func (w *responseTimeWriter) recordResponseTime() {
 		}
 		w.metric.ResponseStatus.WithLabelValues(w.origin, fmt.Sprintf("%d", statusCode)).Inc()
 
+		if w.adaptive != nil {
+			w.adaptive.observe(duration, statusCode)
+		}
+
 		w.recorded = true
 	}
 }
 
 // NewProxy creates a new proxy instance
 func NewProxy(cfg *config.Config, metric *metric.Metric) (*Proxy, error) {
-	limiters := make(map[string]storage.Storage)
 	var authenticator *auth.GoogleAuthenticator
 
-	// Initialize limiters for all configured hosts
-	for host, target := range cfg.RateLimits {
-		if target.PerSecond == -1 && target.Requests == -1 {
-			store := storage.NewFakeStorage()
-			limiters[host] = store
-			log.Printf("Host %s: using fake storage (no rate limiting)", host)
-		} else {
-			var store storage.Storage = storage.NewIPRateLimiter(target.PerSecond, target.Requests)
-			log.Printf("Host %s: using IP rate limiter (%d req/%ds)", host, target.Requests, target.PerSecond)
-			limiters[host] = store
-		}
-	}
-
 	// Initialize Google authenticator if enabled globally
 	if cfg.GoogleAuth != nil && cfg.GoogleAuth.Enabled {
 		authenticator = auth.NewGoogleAuthenticator(
@@ -115,9 +127,14 @@ func NewProxy(cfg *config.Config, metric *metric.Metric) (*Proxy, error) {
 		}
 	}
 
-	return &Proxy{
+	p := &Proxy{
 		config:        cfg,
-		limiters:      limiters,
+		clientIP:      clientip.NewResolver(cfg.IPHeader.Headers, cfg.IPHeader.Trusted),
+		rules:         make(map[string][]middleware.Rule),
+		snapshots:     make(map[string]storage.Snapshotter),
+		concurrency:   make(map[string]*hostConcurrency),
+		bandwidth:     make(map[string]*hostBandwidth),
+		adaptive:      make(map[string]*adaptiveLimit),
 		metric:        metric,
 		auth:          authenticator,
 		loginTemplate: loginTemplate,
@@ -125,24 +142,293 @@ func NewProxy(cfg *config.Config, metric *metric.Metric) (*Proxy, error) {
 		proxyMutex:    sync.RWMutex{},
 		handlerCache:  make(map[string]http.Handler),
 		handlerMutex:  sync.RWMutex{},
-	}, nil
+	}
+
+	if cfg.Redis != nil {
+		p.redis = storage.NewRedisClient(storage.RedisOptions{
+			Address:  cfg.Redis.Address,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+			PoolSize: cfg.Redis.PoolSize,
+			Timeout:  cfg.Redis.Timeout,
+		})
+	}
+
+	if cfg.Cluster != nil {
+		p.cluster = storage.NewCluster(storage.ClusterOptions{
+			NodeID:       cfg.Cluster.NodeID,
+			Peers:        cfg.Cluster.Peers,
+			Secret:       cfg.Cluster.Secret,
+			SyncInterval: cfg.Cluster.SyncInterval,
+			Timeout:      cfg.Cluster.Timeout,
+		})
+		log.Printf("Cluster node %s syncing limiter counters with %d peers", cfg.Cluster.NodeID, len(cfg.Cluster.Peers))
+	}
+
+	// Initialize limiters for all configured hosts
+	for host, target := range cfg.RateLimits {
+		rules, err := p.newRules(host, target)
+		if err != nil {
+			p.closeLimiters()
+			return nil, err
+		}
+		p.rules[host] = rules
+
+		if c := target.Concurrency; c != nil && (c.PerKey > 0 || c.Total > 0) {
+			key, err := middleware.NewKeyExtractor(target.Key, p.keyIP)
+			if err != nil {
+				p.closeLimiters()
+				return nil, fmt.Errorf("host %s: %w", host, err)
+			}
+			log.Printf("Host %s: limiting in-flight requests (%d per key, %d total)", host, c.PerKey, c.Total)
+			p.concurrency[host] = &hostConcurrency{limiter: storage.NewConcurrencyLimiter(c.PerKey, c.Total), key: key}
+		}
+
+		if b := target.Bandwidth; b != nil && (b.PerKey != nil || b.Host != nil) {
+			key, err := middleware.NewKeyExtractor(target.Key, p.keyIP)
+			if err != nil {
+				p.closeLimiters()
+				return nil, fmt.Errorf("host %s: %w", host, err)
+			}
+			log.Printf("Host %s: limiting bandwidth", host)
+			p.bandwidth[host] = newHostBandwidth(b, key)
+		}
+	}
+
+	if cfg.Persistence != nil {
+		if err := os.MkdirAll(cfg.Persistence.Dir, 0o755); err != nil {
+			p.closeLimiters()
+			return nil, fmt.Errorf("failed to create persistence dir: %w", err)
+		}
+		p.restoreSnapshots()
+		p.persistDone = make(chan struct{})
+		go p.persistRoutine()
+	}
+
+	return p, nil
 }
 
-func (p *Proxy) getClientIp(r *http.Request) string {
-	var clientIp string
+// snapshotPath returns the snapshot file of a limiter
+func (p *Proxy) snapshotPath(name string) string {
+	return filepath.Join(p.config.Persistence.Dir, url.PathEscape(name)+".snap")
+}
+
+// restoreSnapshots loads the persisted limiter state, unreadable snapshots are ignored
+func (p *Proxy) restoreSnapshots() {
+	for name, s := range p.snapshots {
+		if err := storage.LoadSnapshot(p.snapshotPath(name), s); err != nil {
+			log.Printf("Limiter %s: ignoring snapshot: %v", name, err)
+		}
+	}
+}
+
+// saveSnapshots writes the state of all persisted limiters
+func (p *Proxy) saveSnapshots() {
+	for name, s := range p.snapshots {
+		if err := storage.SaveSnapshot(p.snapshotPath(name), s); err != nil {
+			log.Printf("Limiter %s: failed to save snapshot: %v", name, err)
+		}
+	}
+}
+
+// persistRoutine periodically saves the limiter snapshots
+func (p *Proxy) persistRoutine() {
+	ticker := time.NewTicker(p.config.Persistence.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.saveSnapshots()
+		case <-p.persistDone:
+			return
+		}
+	}
+}
+
+// newRules creates the ordered rate limit rules of a host, ending with the host-level limit
+func (p *Proxy) newRules(host string, target config.RateLimitConfig) ([]middleware.Rule, error) {
+	rules := make([]middleware.Rule, 0, len(target.Rules)+1)
 
-	for _, header := range p.config.IPHeader.Headers {
-		if ip := r.Header.Get(header); ip != "" {
-			clientIp = ip
-			break
+	for _, rule := range target.Rules {
+		key, err := middleware.NewKeyExtractor(rule.Key, p.keyIP)
+		if err != nil {
+			// The rules are not stored yet, closeLimiters would miss their storages
+			closeRules(host, rules)
+			return nil, fmt.Errorf("host %s rule %s: %w", host, rule.Name, err)
 		}
+
+		rules = append(rules, middleware.Rule{
+			Name:       rule.Name,
+			Methods:    rule.Methods,
+			PathPrefix: rule.PathPrefix,
+			PathRegex:  rule.Regexp,
+			Key:        key,
+			Limiters: []middleware.Limiter{{
+				Name:    "default",
+				Storage: p.newStorage(host+"/"+rule.Name, rule.LimitConfig),
+				Shadow:  rule.Mode == config.ModeShadow,
+			}},
+			Queue: newQueue(rule.LimitConfig),
+			Cost:  rule.Cost,
+		})
+	}
+
+	key, err := middleware.NewKeyExtractor(target.Key, p.keyIP)
+	if err != nil {
+		closeRules(host, rules)
+		return nil, fmt.Errorf("host %s: %w", host, err)
+	}
+
+	// Host-level limit matches every request not caught by a rule
+	fallback := middleware.Rule{
+		Name:  "host",
+		Key:   key,
+		Queue: newQueue(target.LimitConfig),
+	}
+	if target.Tiered {
+		// The tier of the client replaces the host limit
+		fallback.Tiers = p.newTiers(host)
+	} else {
+		fallback.Limiters = []middleware.Limiter{{
+			Name:    "default",
+			Storage: p.newStorage(host, target.LimitConfig),
+			Shadow:  target.Mode == config.ModeShadow,
+		}}
+	}
+	for i, limit := range target.Limits {
+		name := fmt.Sprintf("limit-%d", i+1)
+		fallback.Limiters = append(fallback.Limiters, middleware.Limiter{
+			Name:    name,
+			Storage: p.newStorage(host+"/"+name, limit),
+			Shadow:  limit.Mode == config.ModeShadow,
+		})
+	}
+	if target.Shadow != nil {
+		fallback.Limiters = append(fallback.Limiters, middleware.Limiter{
+			Name:    "shadow",
+			Storage: p.newStorage(host+"/shadow", *target.Shadow),
+			Shadow:  true,
+		})
 	}
 
-	if clientIp == "" {
-		return "empty"
+	rules = append(rules, fallback)
+
+	if target.Adaptive != nil {
+		// The adaptive limit protects the backend as a whole, every rule charges it
+		a := newAdaptiveLimit(host, target.Adaptive, p.metric.EffectiveLimit.WithLabelValues(host))
+		p.adaptive[host] = a
+		for i := range rules {
+			rules[i].Limiters = append(rules[i].Limiters, middleware.Limiter{
+				Name:    "adaptive",
+				Storage: a.storage(),
+			})
+		}
 	}
 
-	return clientIp
+	return rules, nil
+}
+
+// newTiers creates the limiters of every tier for a host
+func (p *Proxy) newTiers(host string) *middleware.TierResolver {
+	tiers := make(map[string]*middleware.Tier, len(p.config.Tiers))
+	for name, tier := range p.config.Tiers {
+		t := &middleware.Tier{Name: name, Limiters: []middleware.Limiter{{
+			Name:    "tier-" + name,
+			Storage: p.newStorage(host+"/tier/"+name, tier.LimitConfig),
+			Shadow:  tier.Mode == config.ModeShadow,
+		}}}
+		for i, limit := range tier.Limits {
+			limitName := fmt.Sprintf("limit-%d", i+1)
+			t.Limiters = append(t.Limiters, middleware.Limiter{
+				Name:    "tier-" + name + "-" + limitName,
+				Storage: p.newStorage(host+"/tier/"+name+"/"+limitName, limit),
+				Shadow:  limit.Mode == config.ModeShadow,
+			})
+		}
+		tiers[name] = t
+	}
+
+	keys := p.config.APIKeys
+	return middleware.NewTierResolver(keys.Header, keys.Keys, tiers, keys.AnonymousTier)
+}
+
+// newQueue creates the wait queue of a limit, nil when requests over the limit are rejected right away
+func newQueue(limit config.LimitConfig) *middleware.WaitQueue {
+	if limit.MaxWait <= 0 {
+		return nil
+	}
+	return middleware.NewWaitQueue(limit.MaxWait, limit.QueueSize)
+}
+
+// newStorage creates the limiter storage for a limit configuration, host also namespaces shared backend keys
+func (p *Proxy) newStorage(host string, limit config.LimitConfig) storage.Storage {
+	if limit.PerSecond == -1 && limit.Requests == -1 {
+		log.Printf("Host %s: using fake storage (no rate limiting)", host)
+		return storage.NewFakeStorage()
+	}
+
+	if limit.Backend == config.BackendRedis {
+		log.Printf("Host %s: using redis sliding window limiter (%d req/%ds, fail %s)", host, limit.Requests, limit.PerSecond, p.config.Redis.FailurePolicy)
+		prefix := p.config.Redis.KeyPrefix + host + ":"
+		return storage.NewRedisLimiter(p.redis, prefix, limit.PerSecond, limit.Requests, p.config.Redis.FailurePolicy == config.FailOpen)
+	}
+
+	if limit.Backend == config.BackendGossip {
+		log.Printf("Host %s: using gossip sliding window limiter (%d req/%ds)", host, limit.Requests, limit.PerSecond)
+		return p.cluster.NewGossipLimiter(host, limit.PerSecond, limit.Requests)
+	}
+
+	limiter := p.newMemoryStorage(host, limit)
+	if snapshotter, ok := limiter.(storage.Snapshotter); ok && p.config.Persistence != nil {
+		p.snapshots[host] = snapshotter
+	}
+	return limiter
+}
+
+// newMemoryStorage creates the in-memory limiter of the configured algorithm
+func (p *Proxy) newMemoryStorage(host string, limit config.LimitConfig) storage.Storage {
+	switch limit.Algorithm {
+	case config.AlgorithmTokenBucket:
+		log.Printf("Host %s: using token bucket limiter (burst %d, %g req/s)", host, limit.Burst, limit.RefillRate)
+		return storage.NewTokenBucketLimiter(limit.Burst, limit.RefillRate)
+	case config.AlgorithmGCRA:
+		log.Printf("Host %s: using GCRA limiter (%d req/%ds)", host, limit.Requests, limit.PerSecond)
+		return storage.NewGCRALimiter(limit.PerSecond, limit.Requests)
+	case config.AlgorithmCalendar:
+		log.Printf("Host %s: using calendar quota (%d req/%s, %s)", host, limit.Requests, limit.Period, limit.Location)
+		period := storage.CalendarDay
+		if limit.Period == config.PeriodMonth {
+			period = storage.CalendarMonth
+		}
+		return storage.NewCalendarLimiter(period, limit.Location, limit.Requests)
+	case config.AlgorithmSlidingWindow:
+		log.Printf("Host %s: using sliding window counter limiter (%d req/%ds)", host, limit.Requests, limit.PerSecond)
+		return storage.NewSlidingWindowLimiter(limit.PerSecond, limit.Requests)
+	default:
+		log.Printf("Host %s: using IP rate limiter (%d req/%ds)", host, limit.Requests, limit.PerSecond)
+		tracked := p.metric.LimiterTrackedKeys.WithLabelValues(host)
+		keys := storage.KeyLimitOptions{
+			MaxKeys:   limit.MaxKeys,
+			OnEvict:   p.metric.LimiterEvictions.WithLabelValues(host).Inc,
+			OnTracked: func(delta int) { tracked.Add(float64(delta)) },
+		}
+		if limit.MaxKeys > 0 {
+			log.Printf("Host %s: tracking at most %d keys", host, limit.MaxKeys)
+		}
+		return storage.NewBoundedIPRateLimiter(limit.PerSecond, limit.Requests, keys)
+	}
+}
+
+// getClientIp returns the client address, headers are only believed from trusted proxies
+func (p *Proxy) getClientIp(r *http.Request) string {
+	return p.clientIP.ClientIP(r)
+}
+
+// keyIP returns the client address used in limiter keys, IPv6 clients are aggregated to the
+// configured prefix so rotating addresses within one network share a limit
+func (p *Proxy) keyIP(r *http.Request) string {
+	return clientip.Aggregate(p.getClientIp(r), p.config.IPv6KeyPrefix)
 }
 
 // normalizeDomain removes www prefix from domain names for consistent metric labeling
@@ -191,7 +477,7 @@ func (p *Proxy) ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	handler.ServeHTTP(w, r)
 }
 
-func (p *Proxy) getOrCreateProxy(targetURL *url.URL, clientIp string) *httputil.ReverseProxy {
+func (p *Proxy) getOrCreateProxy(targetURL *url.URL) *httputil.ReverseProxy {
 	p.proxyMutex.RLock()
 	if proxy, exists := p.proxyCache[targetURL.String()]; exists {
 		p.proxyMutex.RUnlock()
@@ -207,26 +493,22 @@ func (p *Proxy) getOrCreateProxy(targetURL *url.URL, clientIp string) *httputil.
 		return proxy
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
-
-	// Optimize transport for better performance using config values
-	proxy.Transport = &http.Transport{
-		MaxIdleConns:        p.config.Transport.MaxIdleConns,
-		MaxIdleConnsPerHost: p.config.Transport.MaxIdleConnsPerHost,
-		IdleConnTimeout:     p.config.Transport.IdleConnTimeout,
-		TLSHandshakeTimeout: p.config.Transport.TLSHandshakeTimeout,
-		DisableCompression:  p.config.Transport.DisableCompression,
-	}
-
-	originalDirector := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
-		// Remove debug print for production performance
-		// fmt.Println("Request Host Origin:", p.normalizeDomain(req.Host))
-
-		req.Header.Set("X-Forwarded-Host", req.Host)
-		req.Header.Set("X-Forwarded-Proto", req.URL.Scheme)
-		req.Header.Add("X-Forwarded-For", clientIp)
+	proxy := &httputil.ReverseProxy{
+		// Rewrite runs for every request, the cached proxy is shared by all clients of the target
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(targetURL)
+			// Backends see the host requested by the client
+			pr.Out.Host = pr.In.Host
+			p.setForwardedHeaders(pr)
+		},
+		// Optimize transport for better performance using config values
+		Transport: &http.Transport{
+			MaxIdleConns:        p.config.Transport.MaxIdleConns,
+			MaxIdleConnsPerHost: p.config.Transport.MaxIdleConnsPerHost,
+			IdleConnTimeout:     p.config.Transport.IdleConnTimeout,
+			TLSHandshakeTimeout: p.config.Transport.TLSHandshakeTimeout,
+			DisableCompression:  p.config.Transport.DisableCompression,
+		},
 	}
 
 	p.proxyCache[targetURL.String()] = proxy
@@ -273,6 +555,23 @@ func (p *Proxy) getOrCreateHandler(host string) http.Handler {
 		// Normalize domain for consistent metrics
 		p.metric.RequestsTotal.WithLabelValues(normalizedHost).Inc()
 
+		// Hold an in-flight slot until the proxied response is finished, allowlisted clients are never rejected
+		if c := p.concurrency[normalizedHost]; c != nil && !middleware.Exempt(r) {
+			key, _ := c.key.Extract(r)
+			if !c.limiter.Acquire(key) {
+				log.Printf("Concurrency limit exceeded for IP: %s on host: %s", clientIp, normalizedHost)
+				p.metric.RateLimitHits.WithLabelValues(normalizedHost, clientIp).Inc()
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Too many concurrent requests", http.StatusTooManyRequests)
+				return
+			}
+			defer c.limiter.Release(key)
+		}
+
+		activeConnections := p.metric.ActiveConnections.WithLabelValues(normalizedHost)
+		activeConnections.Inc()
+		defer activeConnections.Dec()
+
 		// Create response time writer
 		rtw := &responseTimeWriter{
 			ResponseWriter: w,
@@ -280,12 +579,21 @@ func (p *Proxy) getOrCreateHandler(host string) http.Handler {
 			metric:         p.metric,
 			origin:         normalizedHost,
 			recorded:       false,
+			adaptive:       p.adaptive[normalizedHost],
 		}
 
 		// Ensure response time is recorded when the handler completes
 		defer rtw.recordResponseTime()
 
-		proxy := p.getOrCreateProxy(targetURL, clientIp)
+		// Throttle both bodies when the host limits bandwidth
+		if b := p.bandwidth[normalizedHost]; b != nil {
+			rtw.throttle = b.newThrottle(r, p.metric.BandwidthThrottled.WithLabelValues(normalizedHost, "response"))
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = &throttledBody{ReadCloser: r.Body, throttle: b.newThrottle(r, p.metric.BandwidthThrottled.WithLabelValues(normalizedHost, "request"))}
+			}
+		}
+
+		proxy := p.getOrCreateProxy(targetURL)
 		proxy.ServeHTTP(rtw, r)
 	})
 
@@ -293,28 +601,83 @@ func (p *Proxy) getOrCreateHandler(host string) http.Handler {
 	var handler http.Handler = finalHandler
 
 	// Add rate limiting middleware
-	handler = middleware.NewRateLimitMiddleware(p.config, p.limiters[normalizedHost], normalizedHost, p.getClientIp, p.metric).Handle(handler)
+	handler = middleware.NewRateLimitMiddleware(p.config, p.rules[normalizedHost], normalizedHost, p.getClientIp, p.metric).Handle(handler)
 
 	// Add authentication middleware if enabled
 	if p.auth != nil {
 		handler = middleware.NewAuthMiddleware(p.config, p.auth, normalizedHost, p.loginTemplate).Handle(handler)
 	}
 
+	// The allowlist is evaluated first, it decides whether the other checks apply at all
+	handler = middleware.NewAllowListMiddleware(p.config, normalizedHost, p.getClientIp).Handle(handler)
+
 	p.handlerCache[normalizedHost] = handler
 	return handler
 }
 
+// ClusterHandler returns the endpoint receiving limiter counters from peers, nil when clustering is disabled
+func (p *Proxy) ClusterHandler() http.Handler {
+	if p.cluster == nil {
+		return nil
+	}
+	return p.cluster
+}
+
 // Shutdown gracefully shuts down the proxy and cleans up resources
 func (p *Proxy) Shutdown(ctx context.Context) error {
 	log.Println("Shutting down proxy...")
 
-	// Clean up rate limiters - now using proper Close() interface
-	for host, limiter := range p.limiters {
-		if err := limiter.Close(); err != nil {
-			log.Printf("Error closing limiter for %s: %v", host, err)
-		}
+	// Persist limiter state so the next start continues with the same budgets
+	if p.persistDone != nil {
+		close(p.persistDone)
+		p.saveSnapshots()
 	}
 
+	// Clean up rate limiters - now using proper Close() interface
+	p.closeLimiters()
+
 	log.Println("Proxy shutdown completed")
 	return nil
 }
+
+// closeLimiters closes the storages of all rate limit rules and the shared backends
+func (p *Proxy) closeLimiters() {
+	if p.redis != nil {
+		defer p.redis.Close()
+	}
+	if p.cluster != nil {
+		defer p.cluster.Close()
+	}
+
+	for _, b := range p.bandwidth {
+		b.Close()
+	}
+	for _, a := range p.adaptive {
+		a.Close()
+	}
+
+	for host, rules := range p.rules {
+		closeRules(host, rules)
+	}
+}
+
+// closeRules closes the storages of the rate limit rules of a host
+func closeRules(host string, rules []middleware.Rule) {
+	for _, rule := range rules {
+		for _, limiter := range rule.Limiters {
+			if err := limiter.Storage.Close(); err != nil {
+				log.Printf("Error closing %s/%s limiter for %s: %v", rule.Name, limiter.Name, host, err)
+			}
+		}
+		if rule.Tiers == nil {
+			continue
+		}
+		for _, tier := range rule.Tiers.Tiers() {
+			for _, limiter := range tier.Limiters {
+				if err := limiter.Storage.Close(); err != nil {
+					log.Printf("Error closing %s/%s limiter for %s: %v", rule.Name, limiter.Name, host, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/config"
+	"github.com/JaLe29/ratelimit-simple-proxy/internal/metric"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testMetric is shared by all tests, the metrics can only be registered once
+var testMetric = metric.NewMetric()
+
+// newTestProxy starts a proxy in front of backend, configured by the rateLimits section of the yaml.
+// Both hosts of the config are routed to the backend.
+func newTestProxy(t *testing.T, backend *httptest.Server, rateLimits string) *httptest.Server {
+	t.Helper()
+
+	dir := t.TempDir()
+	yaml := "rateLimits:\n" + fmt.Sprintf(rateLimits, backend.URL)
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewProxy(cfg, testMetric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(p.ProxyHandler))
+	t.Cleanup(func() {
+		server.Close()
+		p.closeLimiters()
+	})
+	return server
+}
+
+// send sends a request for host through the proxy as the given client and returns
+// the status code and body of the response
+func send(t *testing.T, server *httptest.Server, host, client string) (int, string) {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Host = host
+	req.Header.Set("X-Forwarded-For", client)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestProxy_ForwardedPerRequest(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "xff=%q forwarded=%q", r.Header.Get("X-Forwarded-For"), r.Header.Get("Forwarded"))
+	}))
+	defer backend.Close()
+
+	// Both hosts share the cached reverse proxy of the same destination
+	server := newTestProxy(t, backend, `
+  a.example:
+    destination: %[1]s
+    requests: 100
+    perSecond: 60
+  b.example:
+    destination: %[1]s
+    requests: 100
+    perSecond: 60
+    forwardedHeaders: rfc7239
+`)
+
+	// The test client connects from loopback, a trusted proxy, so its X-Forwarded-For is believed
+	tests := []struct {
+		host, client, want string
+	}{
+		{"a.example", "198.51.100.1", `xff="198.51.100.1, 127.0.0.1" forwarded=""`},
+		{"a.example", "198.51.100.2", `xff="198.51.100.2, 127.0.0.1" forwarded=""`},
+		{"b.example", "198.51.100.3", `xff="" forwarded="for=198.51.100.3;proto=http;host=b.example"`},
+		{"a.example", "198.51.100.4", `xff="198.51.100.4, 127.0.0.1" forwarded=""`},
+	}
+
+	for _, tt := range tests {
+		if _, got := send(t, server, tt.host, tt.client); got != tt.want {
+			t.Errorf("Client %s on %s: backend saw %s, want %s", tt.client, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ForwardedResolvedClient(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+
+	server := newTestProxy(t, backend, `
+  a.example:
+    destination: %[1]s
+    requests: 100
+    perSecond: 60
+`)
+
+	// The client resolved from any header of the trusted test client is passed on in X-Forwarded-For
+	tests := []struct {
+		header, value, want string
+	}{
+		{"X-Real-IP", "198.51.100.5", "198.51.100.5, 127.0.0.1"},
+		{"X-Forwarded-For", "198.51.100.6", "198.51.100.6, 127.0.0.1"},
+		{"", "", "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Host = "a.example"
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := string(body); got != tt.want {
+			t.Errorf("Client from %s: backend saw X-Forwarded-For %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_BlackListAndIPv6Keys(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	server := newTestProxy(t, backend, `
+  a.example:
+    destination: %[1]s
+    requests: 2
+    perSecond: 60
+    ipBlackList:
+      - 203.0.113.0/24
+ipBlackList:
+  - 2001:db8:bad::/48
+ipv6KeyPrefix: 64
+`)
+
+	tests := []struct {
+		client string
+		want   int
+	}{
+		{"203.0.113.9", http.StatusForbidden},
+		{"2001:db8:bad:1::5", http.StatusForbidden},
+		{"198.51.100.1", http.StatusOK},
+		// Addresses of one /64 share a limit
+		{"2001:db8:1:2::1", http.StatusOK},
+		{"2001:db8:1:2::2", http.StatusOK},
+		{"2001:db8:1:2::3", http.StatusTooManyRequests},
+		{"2001:db8:1:3::1", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		if got, _ := send(t, server, "a.example", tt.client); got != tt.want {
+			t.Errorf("Client %s: got status %d, want %d", tt.client, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ShadowMode(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	server := newTestProxy(t, backend, `
+  shadow.example:
+    destination: %[1]s
+    requests: 1
+    perSecond: 60
+    mode: shadow
+`)
+
+	// The host limit only records the requests it would block
+	for i := 0; i < 3; i++ {
+		if code, _ := send(t, server, "shadow.example", "198.51.100.1"); code != http.StatusOK {
+			t.Errorf("Request %d: got %d, want 200", i+1, code)
+		}
+	}
+	if got := testutil.ToFloat64(testMetric.RateLimitWouldBlock.WithLabelValues("shadow.example", "host")); got != 2 {
+		t.Errorf("rlsp_rate_limit_would_block_total = %v, want 2", got)
+	}
+}
+
+func TestProxy_ConcurrencySlotReleased(t *testing.T) {
+	started := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			// Drop the connection, the proxy answers 502
+			panic(http.ErrAbortHandler)
+		case "/slow":
+			started <- struct{}{}
+			<-r.Context().Done()
+		}
+	}))
+	defer backend.Close()
+
+	server := newTestProxy(t, backend, `
+  slots.example:
+    destination: %[1]s
+    requests: 100
+    perSecond: 60
+    concurrency:
+      perKey: 1
+`)
+	active := testMetric.ActiveConnections.WithLabelValues("slots.example")
+
+	request := func(ctx context.Context, path string) (*http.Response, error) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+path, nil)
+		req.Host = "slots.example"
+		req.Header.Set("X-Forwarded-For", "198.51.100.1")
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	// released waits until the slot of the client is free again
+	released := func(t *testing.T) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for testutil.ToFloat64(active) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("rlsp_active_connections = %v, want 0", testutil.ToFloat64(active))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if resp, err := request(context.Background(), "/"); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the slot to be free again, got %v, %v", resp, err)
+		}
+	}
+
+	t.Run("success", func(t *testing.T) {
+		if resp, err := request(context.Background(), "/"); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200, got %v, %v", resp, err)
+		}
+		released(t)
+	})
+
+	t.Run("backend error", func(t *testing.T) {
+		if resp, err := request(context.Background(), "/error"); err != nil || resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("Expected 502, got %v, %v", resp, err)
+		}
+		released(t)
+	})
+
+	t.Run("client cancellation", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			request(ctx, "/slow")
+		}()
+
+		<-started
+		if got := testutil.ToFloat64(active); got != 1 {
+			t.Errorf("rlsp_active_connections = %v while in flight, want 1", got)
+		}
+		if resp, err := request(context.Background(), "/"); err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("Expected the slot to be taken, got %v, %v", resp, err)
+		}
+
+		cancel()
+		<-done
+		released(t)
+	})
+}
+
+func TestProxy_AdaptiveHostWide(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	server := newTestProxy(t, backend, `
+  adaptive.example:
+    destination: %[1]s
+    requests: 100
+    perSecond: 60
+    rules:
+      - name: search
+        pathPrefix: /search
+        requests: 100
+        perSecond: 60
+    adaptive:
+      minRequests: 1
+      maxRequests: 2
+      perSecond: 60
+      interval: 1h
+`)
+
+	// Different clients on different rules share the adaptive limit of the backend
+	requests := []struct {
+		path   string
+		client string
+		want   int
+	}{
+		{"/", "198.51.100.1", http.StatusOK},
+		{"/search", "198.51.100.2", http.StatusOK},
+		{"/", "198.51.100.3", http.StatusTooManyRequests},
+		{"/search", "198.51.100.4", http.StatusTooManyRequests},
+	}
+	for _, tt := range requests {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+tt.path, nil)
+		req.Host = "adaptive.example"
+		req.Header.Set("X-Forwarded-For", tt.client)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s from %s: got %d, want %d", tt.path, tt.client, resp.StatusCode, tt.want)
+		}
+	}
+}
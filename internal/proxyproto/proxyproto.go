@@ -0,0 +1,197 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v2Signature starts every binary (v2) PROXY protocol header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLength is the longest valid text (v1) header including CRLF
+const v1MaxLength = 107
+
+// ErrNoHeader is returned when a trusted connection does not start with a PROXY header
+var ErrNoHeader = errors.New("proxy protocol: missing header")
+
+// Listener accepts connections starting with a PROXY protocol header (v1 text or v2 binary) from
+// trusted load balancers and reports the client address of the header as their remote address.
+// Connections from other sources are passed through unchanged, so they cannot spoof a client.
+type Listener struct {
+	net.Listener
+	trusted []netip.Prefix // Load balancers allowed to send PROXY headers
+	timeout time.Duration  // How long a trusted connection may take to send its header
+}
+
+// NewListener wraps inner, headers are only read from connections coming from trusted
+func NewListener(inner net.Listener, trusted []netip.Prefix, timeout time.Duration) *Listener {
+	return &Listener{Listener: inner, trusted: trusted, timeout: timeout}
+}
+
+// Accept waits for the next connection, the header of a trusted one is read on its first use
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+// isTrusted reports whether the address belongs to a trusted load balancer
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := tcp.AddrPort().Addr().Unmap()
+	for _, prefix := range l.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from a trusted load balancer. Its header is read on the first Read or
+// RemoteAddr call, outside of the accept loop, so a slow sender cannot block other connections.
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	remote  net.Addr // Client address of the header, nil for health checks of the balancer
+	err     error    // Invalid header, the connection is unusable
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address of the header, the balancer address when it carries none
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the header within the timeout
+func (c *Conn) readHeader() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+	c.remote, c.err = ReadHeader(c.reader)
+}
+
+// ReadHeader reads a v1 or v2 PROXY header and returns the source address it carries,
+// nil when the header describes a connection of the balancer itself (LOCAL or UNKNOWN)
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+	switch {
+	case bytes.Equal(start, v2Signature):
+		return readV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readV1(r)
+	default:
+		return nil, ErrNoHeader
+	}
+}
+
+// readV1 parses a text header, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxy protocol: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy protocol: v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("proxy protocol: invalid v1 header %q", line)
+	}
+
+	src, err := netip.ParseAddr(fields[2])
+	if err != nil || src.Is4() != (fields[1] == "TCP4") || src.Zone() != "" {
+		return nil, fmt.Errorf("proxy protocol: invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: invalid v1 source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(port))), nil
+}
+
+// readV2 parses a binary header, address families other than IPv4 and IPv6 carry no client address
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol: unsupported version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0x0F {
+	case 0x0: // LOCAL, e.g. health checks of the balancer
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("proxy protocol: unsupported command %d", versionCommand&0x0F)
+	}
+
+	var size int
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		size = 4
+	case 0x2: // AF_INET6
+		size = 16
+	default:
+		return nil, nil
+	}
+	// Source and destination address followed by source and destination port, then TLVs
+	if len(payload) < 2*size+4 {
+		return nil, errors.New("proxy protocol: v2 address block too short")
+	}
+	src, _ := netip.AddrFromSlice(payload[:size])
+	port := binary.BigEndian.Uint16(payload[2*size:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, port)), nil
+}
@@ -0,0 +1,127 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v2Header builds a binary header with the given command, family and address block
+func v2Header(command, family byte, addresses []byte) string {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return string(append(header, addresses...))
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xDC, 0x04, 0x01, 0xBB} // 192.0.2.1:56324 -> 198.51.100.1:443
+	v6 := append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...)
+	v6 = append(v6, 0x30, 0x39, 0x01, 0xBB)
+
+	tests := []struct {
+		name    string
+		header  string
+		want    string // Empty when the header carries no client address
+		wantErr bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n", "[2001:db8::1]:12345", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n", "", true},
+		{"v1 invalid port", "PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n", "", true},
+		{"v1 missing CRLF", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"v2 TCP4", v2Header(0x1, 0x11, v4), "192.0.2.1:56324", false},
+		{"v2 TCP6 with TLV", v2Header(0x1, 0x21, append(v6, 0x04, 0x00, 0x01, 0x00)), "[2001:db8::1]:12345", false},
+		{"v2 LOCAL", v2Header(0x0, 0x00, nil), "", false},
+		{"v2 truncated addresses", v2Header(0x1, 0x11, v4[:6]), "", true},
+		{"v2 unknown command", v2Header(0x2, 0x11, v4), "", true},
+		{"no header", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := ReadHeader(bufio.NewReader(strings.NewReader(tt.header + "GET / HTTP/1.1\r\n")))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("ReadHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// dial connects to the listener, sends data and returns the accepted connection
+func dial(t *testing.T, l net.Listener, data string) net.Conn {
+	t.Helper()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if _, err := io.WriteString(client, data); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+
+	t.Run("trusted balancer", func(t *testing.T) {
+		l := NewListener(inner, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, time.Second)
+		conn := dial(t, l, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello")
+
+		if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+			t.Errorf("Expected the client address of the header, got %s", got)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("Expected the data after the header, got %q, %v", buf, err)
+		}
+	})
+
+	t.Run("untrusted source cannot spoof", func(t *testing.T) {
+		l := NewListener(inner, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, time.Second)
+		conn := dial(t, l, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+
+		if got := conn.RemoteAddr().String(); strings.HasPrefix(got, "192.0.2.1") {
+			t.Errorf("Header of an untrusted source must be ignored, got %s", got)
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if !strings.HasPrefix(line, "PROXY") {
+			t.Errorf("Expected the header to be passed through as data, got %q", line)
+		}
+	})
+
+	t.Run("trusted balancer without header", func(t *testing.T) {
+		l := NewListener(inner, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, time.Second)
+		conn := dial(t, l, "GET / HTTP/1.1\r\n")
+
+		if _, err := conn.Read(make([]byte, 10)); err != ErrNoHeader {
+			t.Errorf("Expected ErrNoHeader, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// CalendarPeriod is the length of a calendar quota period
+type CalendarPeriod int
+
+const (
+	CalendarDay CalendarPeriod = iota
+	CalendarMonth
+)
+
+// CalendarLimiter allows maxRequests per key within each calendar day or month of a
+// timezone. Counts reset at midnight starting the next period, e.g. for monthly quotas.
+type CalendarLimiter struct {
+	mu          sync.Mutex
+	counters    map[string]*calendarCounter // key -> count of the current period
+	period      CalendarPeriod
+	loc         *time.Location
+	maxRequests int
+	now         func() time.Time // Clock, replaceable in tests
+	*cleanupLoop
+}
+
+// calendarCounter holds the requests of a key within one period
+type calendarCounter struct {
+	start time.Time
+	count int
+}
+
+// NewCalendarLimiter creates a limiter allowing maxRequests per calendar period in loc
+func NewCalendarLimiter(period CalendarPeriod, loc *time.Location, maxRequests int) *CalendarLimiter {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	limiter := &CalendarLimiter{
+		counters:    make(map[string]*calendarCounter),
+		period:      period,
+		loc:         loc,
+		maxRequests: maxRequests,
+		now:         time.Now,
+	}
+	// Periods are long, counters of past ones only need to go eventually
+	limiter.cleanupLoop = startCleanup(5*time.Minute, limiter.cleanup)
+
+	return limiter
+}
+
+// bounds returns the start of the period containing now and the start of the next one
+func (r *CalendarLimiter) bounds(now time.Time) (time.Time, time.Time) {
+	t := now.In(r.loc)
+	if r.period == CalendarMonth {
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, r.loc)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, r.loc)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// cleanup removes counters that started before the current period
+func (r *CalendarLimiter) cleanup() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start, _ := r.bounds(r.now())
+	for key, counter := range r.counters {
+		if counter.start.Before(start) {
+			delete(r.counters, key)
+		}
+	}
+}
+
+// DecideN counts n requests in the current period unless they exceed the quota
+func (r *CalendarLimiter) DecideN(key string, n int) Decision {
+	return r.decide(key, n, true)
+}
+
+// PeekN checks n requests against the quota of the current period without counting them
+func (r *CalendarLimiter) PeekN(key string, n int) Decision {
+	return r.decide(key, n, false)
+}
+
+// decide checks n requests against the quota, counting them when allowed and record is set
+func (r *CalendarLimiter) decide(key string, n int, record bool) Decision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	start, end := r.bounds(now)
+
+	counter, exists := r.counters[key]
+	if !exists || !counter.start.Equal(start) {
+		counter = &calendarCounter{start: start}
+		if record {
+			r.counters[key] = counter
+		}
+	}
+
+	decision := Decision{Limit: r.maxRequests, ResetAt: end}
+
+	if counter.count+n > r.maxRequests {
+		decision.Remaining = max(r.maxRequests-counter.count, 0)
+		decision.RetryAfter = end.Sub(now)
+		return decision
+	}
+
+	decision.Allowed = true
+	decision.Remaining = r.maxRequests - counter.count - n
+	if record {
+		counter.count += n
+	}
+	return decision
+}
+
+// Snapshot writes the counters of every key
+func (r *CalendarLimiter) Snapshot(w io.Writer) error {
+	r.mu.Lock()
+	sw := newSnapshotWriter(snapshotCalendar, len(r.counters))
+	for key, counter := range r.counters {
+		sw.entry(key, counter.start.UnixNano(), int64(counter.count))
+	}
+	r.mu.Unlock()
+
+	return sw.writeTo(w)
+}
+
+// Restore loads counters written by Snapshot, only those of the current period are kept
+func (r *CalendarLimiter) Restore(rd io.Reader) error {
+	entries, err := readSnapshot(rd, snapshotCalendar, 2)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start, _ := r.bounds(r.now())
+	for _, e := range entries {
+		if e.values[0] == start.UnixNano() {
+			r.counters[e.key] = &calendarCounter{start: start, count: int(e.values[1])}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalendarLimiter_Day(t *testing.T) {
+	prague, err := time.LoadLocation("Europe/Prague")
+	if err != nil {
+		t.Skipf("Timezone database not available: %v", err)
+	}
+
+	clock := newFakeClock()
+	clock.t = time.Date(2024, 3, 10, 22, 30, 0, 0, time.UTC) // 23:30 in Prague
+	limiter := NewCalendarLimiter(CalendarDay, prague, 2)
+	limiter.now = clock.Now
+	defer limiter.Close()
+
+	limiter.DecideN("a", 1)
+	limiter.DecideN("a", 1)
+	denied := limiter.DecideN("a", 1)
+	if denied.Allowed || denied.RetryAfter != 30*time.Minute {
+		t.Errorf("Expected rejection until midnight in Prague, got %+v", denied)
+	}
+
+	// Midnight in Prague starts a new day
+	clock.Advance(30 * time.Minute)
+	if allowed := limiter.DecideN("a", 1); !allowed.Allowed || allowed.Remaining != 1 {
+		t.Errorf("Expected fresh quota on the next day, got %+v", allowed)
+	}
+}
+
+func TestCalendarLimiter_Month(t *testing.T) {
+	clock := newFakeClock()
+	clock.t = time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	limiter := NewCalendarLimiter(CalendarMonth, time.UTC, 1)
+	limiter.now = clock.Now
+	defer limiter.Close()
+
+	first := limiter.DecideN("a", 1)
+	if want := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC); !first.ResetAt.Equal(want) {
+		t.Errorf("Expected reset at %v, got %v", want, first.ResetAt)
+	}
+	if limiter.DecideN("a", 1).Allowed {
+		t.Error("Second request in the month should be rejected")
+	}
+
+	clock.Advance(12 * time.Hour)
+	if !limiter.DecideN("a", 1).Allowed {
+		t.Error("Quota should reset with the new month")
+	}
+
+	limiter.cleanup()
+	if len(limiter.counters) != 1 {
+		t.Errorf("Expected only the current counter to be kept, got %d", len(limiter.counters))
+	}
+}
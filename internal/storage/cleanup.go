@@ -0,0 +1,40 @@
+package storage
+
+import "time"
+
+// cleanupLoop periodically drops expired keys of an in-memory limiter until the limiter is closed
+type cleanupLoop struct {
+	done chan struct{}
+}
+
+// cleanupInterval adapts the cleanup interval to the window: half of it, between 30s and 5m
+func cleanupInterval(window time.Duration) time.Duration {
+	return min(max(window/2, 30*time.Second), 5*time.Minute)
+}
+
+// startCleanup calls cleanup every interval in its own goroutine
+func startCleanup(interval time.Duration, cleanup func()) *cleanupLoop {
+	l := &cleanupLoop{done: make(chan struct{})}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				cleanup()
+			case <-l.done:
+				return
+			}
+		}
+	}()
+
+	return l
+}
+
+// Close gracefully shuts down the rate limiter
+func (l *cleanupLoop) Close() error {
+	close(l.done)
+	return nil
+}
@@ -0,0 +1,53 @@
+package storage
+
+import "sync"
+
+// ConcurrencyLimiter caps the number of simultaneous in-flight requests per key
+// and in total. Unlike the rate limiters it holds a slot until Release is called.
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	inFlight map[string]int // key -> in-flight requests
+	total    int
+	perKey   int // Max in-flight requests per key, 0 = unlimited
+	maxTotal int // Max in-flight requests over all keys, 0 = unlimited
+}
+
+// NewConcurrencyLimiter creates a limiter allowing perKey in-flight requests per key and maxTotal overall
+func NewConcurrencyLimiter(perKey, maxTotal int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		inFlight: make(map[string]int),
+		perKey:   perKey,
+		maxTotal: maxTotal,
+	}
+}
+
+// Acquire takes a slot for the key, it reports false when the key or the total cap is reached
+func (c *ConcurrencyLimiter) Acquire(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxTotal > 0 && c.total >= c.maxTotal {
+		return false
+	}
+	if c.perKey > 0 && c.inFlight[key] >= c.perKey {
+		return false
+	}
+
+	c.inFlight[key]++
+	c.total++
+	return true
+}
+
+// Release gives back a slot taken by Acquire
+func (c *ConcurrencyLimiter) Release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inFlight[key] <= 1 {
+		// Idle keys are dropped right away, so no cleanup routine is needed
+		delete(c.inFlight, key)
+	} else {
+		c.inFlight[key]--
+	}
+	c.total--
+}
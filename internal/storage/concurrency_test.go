@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConcurrencyLimiter_PerKey(t *testing.T) {
+	limiter := NewConcurrencyLimiter(2, 0)
+
+	if !limiter.Acquire("a") || !limiter.Acquire("a") {
+		t.Fatal("First two requests should get a slot")
+	}
+	if limiter.Acquire("a") {
+		t.Error("Third in-flight request of the same key should be rejected")
+	}
+	if !limiter.Acquire("b") {
+		t.Error("Other keys should not be affected")
+	}
+
+	limiter.Release("a")
+	if !limiter.Acquire("a") {
+		t.Error("Released slot should be available again")
+	}
+}
+
+func TestConcurrencyLimiter_Total(t *testing.T) {
+	limiter := NewConcurrencyLimiter(0, 2)
+
+	limiter.Acquire("a")
+	limiter.Acquire("b")
+	if limiter.Acquire("c") {
+		t.Error("Request over the host total should be rejected")
+	}
+
+	limiter.Release("a")
+	limiter.Release("b")
+	if len(limiter.inFlight) != 0 || limiter.total != 0 {
+		t.Errorf("Expected no in-flight requests, got %v (total %d)", limiter.inFlight, limiter.total)
+	}
+}
+
+func TestConcurrencyLimiter_Concurrent(t *testing.T) {
+	limiter := NewConcurrencyLimiter(5, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limiter.Acquire("a") {
+				limiter.Release("a")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if limiter.total != 0 {
+		t.Errorf("Expected all slots to be released, %d in flight", limiter.total)
+	}
+}
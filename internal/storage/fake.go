@@ -12,6 +12,16 @@ func (r *IPFakeStorage) CheckLimit(ipAddress string) bool {
 	return false
 }
 
+// DecideN always allows the request, the fake storage has no limit
+func (r *IPFakeStorage) DecideN(key string, n int) Decision {
+	return Decision{Allowed: true, Limit: -1, Remaining: -1}
+}
+
+// PeekN always allows the request, whatever its cost
+func (r *IPFakeStorage) PeekN(key string, n int) Decision {
+	return r.DecideN(key, n)
+}
+
 func (r *IPFakeStorage) Close() error {
 	return nil
 }
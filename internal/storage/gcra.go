@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// GCRALimiter limits requests per key using the generic cell rate algorithm.
+// Each key only stores its theoretical arrival time (TAT), so memory per client
+// stays constant regardless of the configured number of requests.
+type GCRALimiter struct {
+	mu               sync.Mutex
+	tats             map[string]int64 // key -> theoretical arrival time in unix nanoseconds
+	windowSecs       int              // Time window in seconds
+	maxRequests      int              // Maximum number of requests in the window
+	emissionInterval int64            // Nanoseconds one request "costs"
+	burstTolerance   int64            // How far ahead of now the TAT may run
+	now              func() time.Time // Clock, replaceable in tests
+	*cleanupLoop
+}
+
+// NewGCRALimiter creates a GCRA limiter allowing maxRequests per windowSeconds
+func NewGCRALimiter(windowSeconds, maxRequests int) *GCRALimiter {
+	window := int64(time.Duration(windowSeconds) * time.Second)
+	emissionInterval := window / int64(maxRequests)
+
+	limiter := &GCRALimiter{
+		tats:             make(map[string]int64),
+		windowSecs:       windowSeconds,
+		maxRequests:      maxRequests,
+		emissionInterval: emissionInterval,
+		burstTolerance:   window - emissionInterval,
+		now:              time.Now,
+	}
+	limiter.cleanupLoop = startCleanup(cleanupInterval(time.Duration(window)), limiter.cleanup)
+
+	return limiter
+}
+
+// cleanup removes keys that have their full budget available again
+func (r *GCRALimiter) cleanup() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now().UnixNano()
+	for key, tat := range r.tats {
+		if tat <= now {
+			delete(r.tats, key)
+		}
+	}
+}
+
+// DecideN records a request costing n emission intervals unless it arrives too early
+func (r *GCRALimiter) DecideN(key string, n int) Decision {
+	return r.decide(key, n, true)
+}
+
+// PeekN checks a request costing n emission intervals without recording it
+func (r *GCRALimiter) PeekN(key string, n int) Decision {
+	return r.decide(key, n, false)
+}
+
+// decide checks a request costing n emission intervals, recording it when allowed and record is set
+func (r *GCRALimiter) decide(key string, n int, record bool) Decision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now().UnixNano()
+
+	tat, exists := r.tats[key]
+	if !exists || tat < now {
+		tat = now
+	}
+
+	decision := Decision{Limit: r.maxRequests}
+
+	// Request arrives too early, the TAT would run past the burst tolerance
+	cost := int64(n-1) * r.emissionInterval
+	if tat+cost-now > r.burstTolerance {
+		decision.RetryAfter = time.Duration(tat + cost - now - r.burstTolerance)
+	} else {
+		tat += cost + r.emissionInterval
+		if record {
+			r.tats[key] = tat
+		}
+		decision.Allowed = true
+	}
+
+	// Every emission interval between the TAT and the end of the tolerance is one request left
+	decision.Remaining = int((now + r.burstTolerance + r.emissionInterval - tat) / r.emissionInterval)
+	decision.ResetAt = time.Unix(0, tat)
+	return decision
+}
+
+// Snapshot writes the theoretical arrival time of every key
+func (r *GCRALimiter) Snapshot(w io.Writer) error {
+	r.mu.Lock()
+	sw := newSnapshotWriter(snapshotGCRA, len(r.tats))
+	for key, tat := range r.tats {
+		sw.entry(key, tat)
+	}
+	r.mu.Unlock()
+
+	return sw.writeTo(w)
+}
+
+// Restore loads theoretical arrival times written by Snapshot, those in the past are dropped
+func (r *GCRALimiter) Restore(rd io.Reader) error {
+	entries, err := readSnapshot(rd, snapshotGCRA, 1)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now().UnixNano()
+	for _, e := range entries {
+		// A lowered limit caps how far ahead the TAT may run
+		if tat := min(e.values[0], now+r.burstTolerance+r.emissionInterval); tat > now {
+			r.tats[e.key] = tat
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGCRALimiter(t *testing.T) {
+	tests := []struct {
+		name        string
+		windowSecs  int
+		maxRequests int
+		steps       []step
+	}{
+		{
+			name:        "allows max requests in window",
+			windowSecs:  1,
+			maxRequests: 2,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+			},
+		},
+		{
+			name:        "budget returns after window",
+			windowSecs:  1,
+			maxRequests: 2,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+				{advance: time.Second, key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+			},
+		},
+		{
+			name:        "requests are spread over the window",
+			windowSecs:  10,
+			maxRequests: 5,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+				{advance: 1 * time.Second, key: "a", exceeded: true},
+				{advance: 1 * time.Second, key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+			},
+		},
+		{
+			name:        "rejected requests do not consume budget",
+			windowSecs:  1,
+			maxRequests: 1,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{advance: 500 * time.Millisecond, key: "a", exceeded: true},
+				{advance: 500 * time.Millisecond, key: "a", exceeded: false},
+			},
+		},
+		{
+			name:        "keys are independent",
+			windowSecs:  1,
+			maxRequests: 1,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{key: "b", exceeded: false},
+				{key: "a", exceeded: true},
+				{key: "b", exceeded: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter := NewGCRALimiter(tt.windowSecs, tt.maxRequests)
+			limiter.now = clock.Now
+			defer limiter.Close()
+
+			for i, s := range tt.steps {
+				clock.Advance(s.advance)
+				if got := exceeded(limiter, s.key); got != s.exceeded {
+					t.Errorf("step %d (%s): expected exceeded=%v, got %v", i, s.key, s.exceeded, got)
+				}
+			}
+		})
+	}
+}
+
+func TestGCRALimiter_Decide(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewGCRALimiter(10, 5)
+	limiter.now = clock.Now
+	defer limiter.Close()
+
+	first := limiter.DecideN("a", 1)
+	if !first.Allowed || first.Limit != 5 || first.Remaining != 4 {
+		t.Errorf("Unexpected first decision: %+v", first)
+	}
+	if want := clock.Now().Add(2 * time.Second); !first.ResetAt.Equal(want) {
+		t.Errorf("Expected reset at %v, got %v", want, first.ResetAt)
+	}
+
+	for i := 0; i < 4; i++ {
+		limiter.DecideN("a", 1)
+	}
+
+	denied := limiter.DecideN("a", 1)
+	if denied.Allowed || denied.Remaining != 0 || denied.RetryAfter != 2*time.Second {
+		t.Errorf("Unexpected denied decision: %+v", denied)
+	}
+	if want := clock.Now().Add(10 * time.Second); !denied.ResetAt.Equal(want) {
+		t.Errorf("Expected reset at %v, got %v", want, denied.ResetAt)
+	}
+}
+
+func TestGCRALimiter_DecideN(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewGCRALimiter(10, 10) // One unit per second, burst of 10
+	limiter.now = clock.Now
+	defer limiter.Close()
+
+	if d := limiter.DecideN("a", 4); !d.Allowed || d.Remaining != 6 {
+		t.Errorf("Unexpected decision for cost 4: %+v", d)
+	}
+
+	denied := limiter.DecideN("a", 7)
+	if denied.Allowed || denied.RetryAfter != time.Second {
+		t.Errorf("Expected cost 7 to wait one second, got %+v", denied)
+	}
+
+	clock.Advance(time.Second)
+	if d := limiter.DecideN("a", 7); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("Unexpected decision after retry-after: %+v", d)
+	}
+}
+
+func TestGCRALimiter_Cleanup(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewGCRALimiter(1, 2)
+	limiter.now = clock.Now
+	defer limiter.Close()
+
+	exceeded(limiter, "192.168.1.1")
+	exceeded(limiter, "192.168.1.2")
+	exceeded(limiter, "192.168.1.2")
+
+	clock.Advance(500 * time.Millisecond)
+	limiter.cleanup()
+
+	if len(limiter.tats) != 1 {
+		t.Fatalf("Expected 1 key after cleanup, got %d", len(limiter.tats))
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	limiter.cleanup()
+
+	if len(limiter.tats) != 0 {
+		t.Errorf("Expected all keys to be cleaned up, got %d", len(limiter.tats))
+	}
+}
+
+// Compare GCRA with IPRateLimiter at high request counts, where the sliding log
+// allocates a timestamp buffer of maxRequests entries for every client
+func BenchmarkLimiters_HighRequestCount(b *testing.B) {
+	const maxRequests = 10000
+	const clients = 1000
+
+	ips := make([]string, clients)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+	}
+
+	limiters := []struct {
+		name string
+		new  func() Storage
+	}{
+		{"IPRateLimiter", func() Storage { return NewIPRateLimiter(60, maxRequests) }},
+		{"GCRALimiter", func() Storage { return NewGCRALimiter(60, maxRequests) }},
+	}
+
+	for _, l := range limiters {
+		b.Run(l.name, func(b *testing.B) {
+			limiter := l.new()
+			defer limiter.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				exceeded(limiter, ips[i%clients])
+			}
+		})
+	}
+}
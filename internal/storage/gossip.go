@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterSecretHeader carries the shared secret authenticating gossip between peers
+const ClusterSecretHeader = "X-RLSP-Cluster-Secret"
+
+// Bounds of the state a peer can push, so even an authenticated peer cannot grow memory without limit
+const (
+	maxGossipKeys       = 50000  // Keys over all limiters of one message
+	maxGossipNodes      = 64     // Peer nodes tracked per key
+	maxGossipRemoteKeys = 200000 // Keys only known from peers tracked per limiter, the oldest are evicted
+)
+
+// ClusterOptions configures the peer-to-peer synchronisation of limiter counters
+type ClusterOptions struct {
+	NodeID       string        // Unique name of this replica
+	Peers        []string      // Base URLs of the other replicas
+	Secret       string        // Shared secret, a cluster without one rejects all pushed counters
+	SyncInterval time.Duration // How often counters are pushed to peers
+	Timeout      time.Duration // Timeout of a single push
+}
+
+// Cluster pushes the counters of its gossip limiters to peers and merges the
+// counters received from them. Every node only ever reports its own counts, so
+// the per-node counters form a grow-only counter (G-counter) per window.
+type Cluster struct {
+	opts     ClusterOptions
+	client   *http.Client
+	mu       sync.RWMutex
+	limiters map[string]*GossipLimiter // name -> limiter
+	done     chan struct{}
+}
+
+// gossipMessage is the payload exchanged between nodes
+type gossipMessage struct {
+	Node     string                                  `json:"node"`
+	Limiters map[string]map[string]gossipWindowState `json:"limiters"` // limiter -> key -> counts
+}
+
+// gossipWindowState are the counts of one node for one key
+type gossipWindowState struct {
+	Index    int64 `json:"index"`
+	Current  int   `json:"current"`
+	Previous int   `json:"previous"`
+}
+
+// NewCluster creates a cluster and starts pushing counters to the peers
+func NewCluster(opts ClusterOptions) *Cluster {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 500 * time.Millisecond
+	}
+
+	c := &Cluster{
+		opts:     opts,
+		client:   &http.Client{Timeout: opts.Timeout},
+		limiters: make(map[string]*GossipLimiter),
+		done:     make(chan struct{}),
+	}
+
+	go c.syncRoutine()
+
+	return c
+}
+
+// syncRoutine periodically pushes local counters to all peers
+func (c *Cluster) syncRoutine() {
+	ticker := time.NewTicker(c.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.sync()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// sync pushes the local counters to every peer, unreachable peers are skipped.
+// Counters are split into messages of at most maxGossipKeys keys.
+func (c *Cluster) sync() {
+	var messages []gossipMessage
+	msg := gossipMessage{Node: c.opts.NodeID, Limiters: make(map[string]map[string]gossipWindowState)}
+	keys := 0
+
+	c.mu.RLock()
+	for name, limiter := range c.limiters {
+		for key, state := range limiter.localState() {
+			if keys == maxGossipKeys {
+				messages = append(messages, msg)
+				msg = gossipMessage{Node: c.opts.NodeID, Limiters: make(map[string]map[string]gossipWindowState)}
+				keys = 0
+			}
+			if msg.Limiters[name] == nil {
+				msg.Limiters[name] = make(map[string]gossipWindowState)
+			}
+			msg.Limiters[name][key] = state
+			keys++
+		}
+	}
+	c.mu.RUnlock()
+
+	if keys > 0 {
+		messages = append(messages, msg)
+	}
+
+	for _, msg := range messages {
+		body, err := json.Marshal(msg)
+		if err != nil {
+			log.Printf("Gossip: failed to encode counters: %v", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, peer := range c.opts.Peers {
+			wg.Add(1)
+			go func(peer string) {
+				defer wg.Done()
+				if err := c.push(peer, body); err != nil {
+					log.Printf("Gossip: failed to sync with %s: %v", peer, err)
+				}
+			}(peer)
+		}
+		wg.Wait()
+	}
+}
+
+func (c *Cluster) push(peer string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(peer, "/")+"/rlsp/system/gossip", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ClusterSecretHeader, c.opts.Secret)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ServeHTTP receives counters pushed by a peer
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authenticated(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var msg gossipMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 10<<20)).Decode(&msg); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	if msg.Node == "" || msg.Node == c.opts.NodeID {
+		http.Error(w, "Invalid node", http.StatusBadRequest)
+		return
+	}
+	keys := 0
+	for _, state := range msg.Limiters {
+		keys += len(state)
+	}
+	if keys > maxGossipKeys {
+		http.Error(w, "Too many keys", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	c.mu.RLock()
+	for name, state := range msg.Limiters {
+		if limiter, ok := c.limiters[name]; ok {
+			limiter.merge(msg.Node, state)
+		}
+	}
+	c.mu.RUnlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticated reports whether the request carries the shared secret, compared in constant time
+func (c *Cluster) authenticated(r *http.Request) bool {
+	if c.opts.Secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(ClusterSecretHeader)), []byte(c.opts.Secret)) == 1
+}
+
+// Close stops pushing counters to peers
+func (c *Cluster) Close() error {
+	close(c.done)
+	return nil
+}
+
+// GossipLimiter is a sliding window counter limiter whose counts are summed
+// across all nodes of the cluster. When peers are unreachable their counts
+// expire with the window and the limiter falls back to local counts only.
+type GossipLimiter struct {
+	mu          sync.Mutex
+	cluster     *Cluster
+	name        string
+	counters    map[string]*gossipCounter // key -> counters of all nodes
+	remote      *list.List                // Keys only known from peers, oldest first
+	maxRemote   int                       // Keys only known from peers tracked at most
+	window      time.Duration
+	windowSecs  int
+	maxRequests int
+	now         func() time.Time // Clock, replaceable in tests
+	*cleanupLoop
+}
+
+// gossipCounter holds the counts of this node and the last known counts of peers
+type gossipCounter struct {
+	local  windowCounter
+	peers  map[string]*windowCounter // node ID -> counts
+	remote *list.Element             // Position in GossipLimiter.remote, nil once counted locally
+}
+
+// NewGossipLimiter creates a limiter allowing maxRequests per windowSeconds across the
+// cluster, the name must be the same on every node
+func (c *Cluster) NewGossipLimiter(name string, windowSeconds, maxRequests int) *GossipLimiter {
+	limiter := &GossipLimiter{
+		cluster:     c,
+		name:        name,
+		counters:    make(map[string]*gossipCounter),
+		remote:      list.New(),
+		maxRemote:   maxGossipRemoteKeys,
+		window:      time.Duration(windowSeconds) * time.Second,
+		windowSecs:  windowSeconds,
+		maxRequests: maxRequests,
+		now:         time.Now,
+	}
+
+	c.mu.Lock()
+	c.limiters[name] = limiter
+	c.mu.Unlock()
+
+	limiter.cleanupLoop = startCleanup(cleanupInterval(limiter.window), limiter.cleanup)
+
+	return limiter
+}
+
+// localState returns the counts of this node for all keys active in the last two windows
+func (r *GossipLimiter) localState() map[string]gossipWindowState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	index := r.now().UnixNano() / int64(r.window)
+	state := make(map[string]gossipWindowState)
+	for key, counter := range r.counters {
+		local := counter.local
+		local.advance(index)
+		if local.current > 0 || local.previous > 0 {
+			state[key] = gossipWindowState{Index: local.index, Current: local.current, Previous: local.previous}
+		}
+	}
+	return state
+}
+
+// merge applies counts received from a peer, counts only grow within a window.
+// Keys already tracking maxGossipNodes peers ignore counts of further nodes, and
+// beyond maxRemote keys only known from peers the oldest of them are evicted.
+func (r *GossipLimiter) merge(node string, state map[string]gossipWindowState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, s := range state {
+		counter, exists := r.counters[key]
+		if !exists {
+			if r.remote.Len() >= r.maxRemote {
+				r.remove(r.remote.Front().Value.(string))
+			}
+			counter = &gossipCounter{local: windowCounter{index: s.Index}}
+			counter.remote = r.remote.PushBack(key)
+			r.counters[key] = counter
+		}
+		if counter.peers == nil {
+			counter.peers = make(map[string]*windowCounter)
+		}
+
+		peer, exists := counter.peers[node]
+		if !exists && len(counter.peers) >= maxGossipNodes {
+			continue
+		}
+		switch {
+		case !exists || s.Index > peer.index:
+			counter.peers[node] = &windowCounter{index: s.Index, current: s.Current, previous: s.Previous}
+		case s.Index == peer.index:
+			peer.current = max(peer.current, s.Current)
+			peer.previous = max(peer.previous, s.Previous)
+		}
+	}
+}
+
+// cleanup removes keys without counts from any node in the current or previous window
+func (r *GossipLimiter) cleanup() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	index := r.now().UnixNano() / int64(r.window)
+	for key, counter := range r.counters {
+		for node, peer := range counter.peers {
+			if peer.index < index-1 {
+				delete(counter.peers, node)
+			}
+		}
+		if counter.local.index < index-1 && len(counter.peers) == 0 {
+			r.remove(key)
+		}
+	}
+}
+
+// remove stops tracking a key
+func (r *GossipLimiter) remove(key string) {
+	if counter := r.counters[key]; counter.remote != nil {
+		r.remote.Remove(counter.remote)
+	}
+	delete(r.counters, key)
+}
+
+// DecideN records n requests for the key unless the weighted cluster-wide count would exceed the limit
+func (r *GossipLimiter) DecideN(key string, n int) Decision {
+	return r.decide(key, n, true)
+}
+
+// PeekN checks n requests for the key against the cluster-wide count without recording them
+func (r *GossipLimiter) PeekN(key string, n int) Decision {
+	return r.decide(key, n, false)
+}
+
+// decide checks n requests for the key, recording them when allowed and record is set
+func (r *GossipLimiter) decide(key string, n int, record bool) Decision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now().UnixNano()
+	window := int64(r.window)
+	index := now / window
+
+	counter, exists := r.counters[key]
+	if !exists {
+		counter = &gossipCounter{local: windowCounter{index: index}}
+		if record {
+			r.counters[key] = counter
+		}
+	}
+	counter.local.advance(index)
+
+	// Sum the counts of all nodes, peers lagging behind are moved to the current window
+	total := counter.local
+	for _, peer := range counter.peers {
+		p := *peer
+		p.advance(index)
+		total.current += p.current
+		total.previous += p.previous
+	}
+
+	elapsed := float64(now%window) / float64(window)
+	estimate := float64(total.previous)*(1-elapsed) + float64(total.current)
+
+	decision := Decision{Limit: r.maxRequests, ResetAt: time.Unix(0, (index+2)*window)}
+
+	if estimate+float64(n) > float64(r.maxRequests) {
+		decision.Remaining = max(int(float64(r.maxRequests)-estimate), 0)
+		decision.RetryAfter = slidingWindowRetryAfter(&total, now, window, r.maxRequests, n)
+		return decision
+	}
+
+	if record {
+		counter.local.current += n
+		// Keys of local clients are never evicted for remote ones
+		if counter.remote != nil {
+			r.remote.Remove(counter.remote)
+			counter.remote = nil
+		}
+	}
+	decision.Allowed = true
+	decision.Remaining = int(float64(r.maxRequests) - estimate - float64(n))
+	return decision
+}
+
+// Close gracefully shuts down the rate limiter
+func (r *GossipLimiter) Close() error {
+	r.cluster.mu.Lock()
+	delete(r.cluster.limiters, r.name)
+	r.cluster.mu.Unlock()
+
+	return r.cleanupLoop.Close()
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestNode starts a cluster node serving gossip on a test server
+func newTestNode(t *testing.T, id, secret string) (*Cluster, *httptest.Server) {
+	t.Helper()
+
+	cluster := NewCluster(ClusterOptions{NodeID: id, Secret: secret, SyncInterval: time.Hour})
+	server := httptest.NewServer(cluster)
+	t.Cleanup(func() {
+		server.Close()
+		cluster.Close()
+	})
+	return cluster, server
+}
+
+func TestGossipLimiter_ClusterWideLimit(t *testing.T) {
+	clock := newFakeClock()
+	a, serverA := newTestNode(t, "a", "secret")
+	b, serverB := newTestNode(t, "b", "secret")
+	a.opts.Peers = []string{serverB.URL}
+	b.opts.Peers = []string{serverA.URL}
+
+	limiterA := a.NewGossipLimiter("host", 10, 4)
+	limiterA.now = clock.Now
+	defer limiterA.Close()
+	limiterB := b.NewGossipLimiter("host", 10, 4)
+	limiterB.now = clock.Now
+	defer limiterB.Close()
+
+	// Each node sees only half of the budget used locally
+	for i := 0; i < 2; i++ {
+		if exceeded(limiterA, "192.168.1.1") || exceeded(limiterB, "192.168.1.1") {
+			t.Fatalf("Request %d should not exceed limit", i+1)
+		}
+	}
+
+	a.sync()
+	b.sync()
+
+	// After exchanging counters the cluster-wide budget is used up
+	if !exceeded(limiterA, "192.168.1.1") {
+		t.Error("Node a should see the cluster-wide limit exceeded")
+	}
+	if !exceeded(limiterB, "192.168.1.1") {
+		t.Error("Node b should see the cluster-wide limit exceeded")
+	}
+
+	// Other keys are unaffected
+	if exceeded(limiterA, "192.168.1.2") {
+		t.Error("Different IP should not exceed limit")
+	}
+}
+
+func TestGossipLimiter_PeerCountsExpire(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := newTestNode(t, "a", "")
+
+	limiter := a.NewGossipLimiter("host", 10, 2)
+	limiter.now = clock.Now
+	defer limiter.Close()
+
+	index := clock.Now().UnixNano() / int64(10*time.Second)
+	limiter.merge("b", map[string]gossipWindowState{"192.168.1.1": {Index: index, Current: 2}})
+
+	if !exceeded(limiter, "192.168.1.1") {
+		t.Error("Peer counts should be included")
+	}
+
+	// Peer stops reporting, its counts leave the sliding window
+	clock.Advance(20 * time.Second)
+	if exceeded(limiter, "192.168.1.1") {
+		t.Error("Expired peer counts should no longer be included")
+	}
+}
+
+func TestGossipLimiter_UnreachablePeer(t *testing.T) {
+	a, _ := newTestNode(t, "a", "")
+	a.opts.Peers = []string{"http://127.0.0.1:1"}
+	a.opts.Timeout = 100 * time.Millisecond
+
+	limiter := a.NewGossipLimiter("host", 10, 1)
+	defer limiter.Close()
+
+	if exceeded(limiter, "192.168.1.1") {
+		t.Error("First request should not exceed limit")
+	}
+	a.sync()
+	if !exceeded(limiter, "192.168.1.1") {
+		t.Error("Local limit should still apply when peers are unreachable")
+	}
+}
+
+func TestCluster_RejectsWrongSecret(t *testing.T) {
+	a, _ := newTestNode(t, "a", "right")
+	_, serverB := newTestNode(t, "b", "wrong")
+
+	if err := a.push(serverB.URL, []byte(`{"node":"a","limiters":{}}`)); err == nil {
+		t.Error("Expected push with mismatching secret to fail")
+	}
+}
+
+// pushTo posts a gossip message to the node with the given secret, empty sends none
+func pushTo(t *testing.T, cluster *Cluster, secret string, msg gossipMessage) int {
+	t.Helper()
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/rlsp/system/gossip", strings.NewReader(string(body)))
+	if secret != "" {
+		req.Header.Set(ClusterSecretHeader, secret)
+	}
+	rec := httptest.NewRecorder()
+	cluster.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestCluster_RejectsUnauthenticated(t *testing.T) {
+	tests := []struct {
+		name       string
+		nodeSecret string
+		sent       string
+	}{
+		{"missing secret", "right", ""},
+		{"wrong secret", "right", "wrong"},
+		{"secret prefix", "right", "righ"},
+		{"node without secret", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestNode(t, "a", tt.nodeSecret)
+			limiter := a.NewGossipLimiter("host", 10, 2)
+			defer limiter.Close()
+
+			index := limiter.now().UnixNano() / int64(10*time.Second)
+			msg := gossipMessage{Node: "attacker", Limiters: map[string]map[string]gossipWindowState{
+				"host": {"192.168.1.1": {Index: index, Current: 1000}},
+			}}
+			if code := pushTo(t, a, tt.sent, msg); code != http.StatusForbidden {
+				t.Errorf("Expected 403, got %d", code)
+			}
+
+			if len(limiter.counters) != 0 {
+				t.Errorf("Rejected push changed state: %d keys tracked", len(limiter.counters))
+			}
+			if exceeded(limiter, "192.168.1.1") {
+				t.Error("Rejected push should not count against the victim")
+			}
+		})
+	}
+}
+
+func TestCluster_RejectsTooManyKeys(t *testing.T) {
+	a, _ := newTestNode(t, "a", "secret")
+	limiter := a.NewGossipLimiter("host", 10, 2)
+	defer limiter.Close()
+
+	state := make(map[string]gossipWindowState, maxGossipKeys+1)
+	for i := 0; i <= maxGossipKeys; i++ {
+		state[fmt.Sprintf("key-%d", i)] = gossipWindowState{Current: 1}
+	}
+	msg := gossipMessage{Node: "b", Limiters: map[string]map[string]gossipWindowState{"host": state}}
+
+	if code := pushTo(t, a, "secret", msg); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", code)
+	}
+	if len(limiter.counters) != 0 {
+		t.Errorf("Rejected push changed state: %d keys tracked", len(limiter.counters))
+	}
+}
+
+func TestGossipLimiter_MaxNodesPerKey(t *testing.T) {
+	a, _ := newTestNode(t, "a", "secret")
+	limiter := a.NewGossipLimiter("host", 10, 2)
+	defer limiter.Close()
+
+	for i := 0; i <= maxGossipNodes; i++ {
+		limiter.merge(fmt.Sprintf("node-%d", i), map[string]gossipWindowState{"192.168.1.1": {Current: 1}})
+	}
+	if got := len(limiter.counters["192.168.1.1"].peers); got != maxGossipNodes {
+		t.Errorf("Expected %d tracked nodes, got %d", maxGossipNodes, got)
+	}
+}
+
+func TestGossipLimiter_MaxRemoteKeys(t *testing.T) {
+	a, _ := newTestNode(t, "a", "secret")
+	limiter := a.NewGossipLimiter("host", 10, 2)
+	defer limiter.Close()
+	limiter.maxRemote = 3
+
+	limiter.DecideN("local", 1)
+
+	// Keys pushed over several messages count towards the same cap
+	for i := range 5 {
+		limiter.merge("b", map[string]gossipWindowState{fmt.Sprintf("remote-%d", i): {Current: 1}})
+	}
+
+	if got := len(limiter.counters); got != 4 {
+		t.Errorf("Expected 3 remote keys and the local one, got %d keys", got)
+	}
+	for _, key := range []string{"remote-0", "remote-1"} {
+		if _, ok := limiter.counters[key]; ok {
+			t.Errorf("Expected the oldest remote key %s to be evicted", key)
+		}
+	}
+	if _, ok := limiter.counters["local"]; !ok {
+		t.Error("Local keys must not be evicted")
+	}
+
+	// A remote key used locally no longer counts as remote
+	limiter.DecideN("remote-2", 1)
+	limiter.merge("b", map[string]gossipWindowState{"remote-5": {Current: 1}})
+	if _, ok := limiter.counters["remote-2"]; !ok {
+		t.Error("Expected remote-2 to be kept once counted locally")
+	}
+	if got := limiter.remote.Len(); got != 3 {
+		t.Errorf("Expected 3 remote keys, got %d", got)
+	}
+}
@@ -1,17 +1,40 @@
 package storage
 
 import (
+	"container/list"
+	"io"
+	"sort"
 	"sync"
 	"time"
 )
 
-// IPRateLimiter představuje rate limiter na základě IP adres
+// Number of shards of an unbounded IPRateLimiter
+const ipRateLimiterShards = 32
+
+// IPRateLimiter představuje rate limiter na základě IP adres.
+// Keys are spread over shards with their own lock so requests of different
+// IP addresses do not contend on a single mutex.
 type IPRateLimiter struct {
-	mu          sync.RWMutex
-	accessMap   map[string]*accessWindow // IP adresa -> access window
-	windowSecs  int                      // Časové okno v sekundách
-	maxRequests int                      // Maximální počet požadavků v okně
-	cleanupDone chan struct{}            // Channel pro graceful shutdown cleanup
+	shards      []*ipShard
+	windowSecs  int // Časové okno v sekundách
+	maxRequests int // Maximální počet požadavků v okně
+	keys        KeyLimitOptions
+	*cleanupLoop
+}
+
+// ipShard holds the access windows of the keys hashed to it
+type ipShard struct {
+	mu        sync.RWMutex
+	accessMap map[string]*accessWindow // IP adresa -> access window
+	lru       *list.List               // Keys ordered by last access, front is the most recent (nil when unbounded)
+	maxKeys   int                      // Share of KeyLimitOptions.MaxKeys of this shard
+}
+
+// KeyLimitOptions bounds the memory of a limiter by capping the number of tracked keys
+type KeyLimitOptions struct {
+	MaxKeys   int             // Maximum number of tracked keys, the least recently used are evicted (0 = unbounded)
+	OnEvict   func()          // Called for every evicted key
+	OnTracked func(delta int) // Called with the change of the number of tracked keys
 }
 
 // accessWindow represents a sliding window of access times using circular buffer
@@ -22,6 +45,7 @@ type accessWindow struct {
 	count       int // Number of valid elements
 	capacity    int // Buffer capacity
 	lastCleanup time.Time
+	elem        *list.Element // Position in the LRU list of a bounded limiter
 }
 
 // newAccessWindow creates a new access window with circular buffer
@@ -60,6 +84,40 @@ func (w *accessWindow) countValid(cutoffTime time.Time) int {
 	return validCount
 }
 
+// nthValid returns the n-th oldest access within the time window, counting from zero
+func (w *accessWindow) nthValid(cutoffTime time.Time, n int) (time.Time, bool) {
+	for i := 0; i < w.count; i++ {
+		idx := (w.head + i) % w.capacity
+		if w.accesses[idx].After(cutoffTime) {
+			if n == 0 {
+				return w.accesses[idx], true
+			}
+			n--
+		}
+	}
+	return time.Time{}, false
+}
+
+// newest returns the most recent access
+func (w *accessWindow) newest() (time.Time, bool) {
+	if w.count == 0 {
+		return time.Time{}, false
+	}
+	return w.accesses[(w.tail-1+w.capacity)%w.capacity], true
+}
+
+// validAccesses returns the accesses within the time window, oldest first
+func (w *accessWindow) validAccesses(cutoffTime time.Time) []time.Time {
+	var accesses []time.Time
+	for i := 0; i < w.count; i++ {
+		idx := (w.head + i) % w.capacity
+		if w.accesses[idx].After(cutoffTime) {
+			accesses = append(accesses, w.accesses[idx])
+		}
+	}
+	return accesses
+}
+
 // cleanup removes old entries from the window
 func (w *accessWindow) cleanup(cutoffTime time.Time) {
 	newHead := w.head
@@ -81,101 +139,279 @@ func (w *accessWindow) cleanup(cutoffTime time.Time) {
 
 // NewIPRateLimiter vytvoří novou instanci rate limiteru
 func NewIPRateLimiter(windowSeconds, maxRequests int) *IPRateLimiter {
+	return NewBoundedIPRateLimiter(windowSeconds, maxRequests, KeyLimitOptions{})
+}
+
+// NewBoundedIPRateLimiter creates a rate limiter tracking at most keys.MaxKeys keys.
+// Every shard evicts its own least recently used keys, so eviction order is approximate.
+func NewBoundedIPRateLimiter(windowSeconds, maxRequests int, keys KeyLimitOptions) *IPRateLimiter {
+	shards := ipRateLimiterShards
+	if keys.MaxKeys > 0 {
+		// Keep a few hundred keys per shard so uneven hashing does not evict early
+		shards = max(1, min(ipRateLimiterShards, keys.MaxKeys/256))
+	}
+	return newShardedIPRateLimiter(windowSeconds, maxRequests, shards, keys)
+}
+
+// newShardedIPRateLimiter creates a rate limiter with the given number of shards
+func newShardedIPRateLimiter(windowSeconds, maxRequests, shards int, keys KeyLimitOptions) *IPRateLimiter {
 	limiter := &IPRateLimiter{
-		accessMap:   make(map[string]*accessWindow),
+		shards:      make([]*ipShard, shards),
 		windowSecs:  windowSeconds,
 		maxRequests: maxRequests,
-		cleanupDone: make(chan struct{}),
+		keys:        keys,
+	}
+	for i := range limiter.shards {
+		shard := &ipShard{accessMap: make(map[string]*accessWindow)}
+		if keys.MaxKeys > 0 {
+			shard.lru = list.New()
+			shard.maxKeys = (keys.MaxKeys + shards - 1) / shards
+		}
+		limiter.shards[i] = shard
 	}
 
 	// Spustit goroutinu pro pravidelné čištění s optimalizovaným intervalem
-	go limiter.cleanupRoutine()
+	limiter.cleanupLoop = startCleanup(cleanupInterval(time.Duration(windowSeconds)*time.Second), limiter.cleanup)
 
 	return limiter
 }
 
-// cleanupRoutine spouští pravidelné čištění s adaptive interval
-func (r *IPRateLimiter) cleanupRoutine() {
-	// Adaptive cleanup interval based on window size
-	interval := time.Duration(r.windowSecs/2) * time.Second
-	if interval < 30*time.Second {
-		interval = 30 * time.Second
+// shard returns the shard of a key using FNV-1a
+func (r *IPRateLimiter) shard(key string) *ipShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
 	}
-	if interval > 5*time.Minute {
-		interval = 5 * time.Minute
-	}
-
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	return r.shards[hash%uint32(len(r.shards))]
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			r.cleanup()
-		case <-r.cleanupDone:
-			return
-		}
+// cleanup odstraňuje staré záznamy, shard po shardu
+func (r *IPRateLimiter) cleanup() {
+	for _, shard := range r.shards {
+		r.cleanupShard(shard)
 	}
 }
 
-// cleanup odstraňuje staré záznamy optimalizovaným způsobem
-func (r *IPRateLimiter) cleanup() {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// cleanupShard removes expired keys of one shard, other shards keep serving requests
+func (r *IPRateLimiter) cleanupShard(shard *ipShard) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
 	now := time.Now()
 	cutoffTime := now.Add(-time.Duration(r.windowSecs) * time.Second)
 
-	// Optimized cleanup - only process IPs that haven't been cleaned recently
-	for ip, window := range r.accessMap {
+	removed := 0
+	for ip, window := range shard.accessMap {
+		// Drop windows whose newest access already left the time window
+		if newest, ok := window.newest(); !ok || !newest.After(cutoffTime) {
+			shard.remove(ip, window)
+			removed++
+			continue
+		}
+
 		// Skip if recently cleaned (within last cleanup interval)
 		if window.lastCleanup.Add(30 * time.Second).After(now) {
 			continue
 		}
 
 		window.cleanup(cutoffTime)
+	}
+	r.tracked(-removed)
+}
 
-		// Remove empty windows
-		if window.count == 0 {
-			delete(r.accessMap, ip)
+// track starts tracking a key, evicting the least recently used keys when the shard is full
+func (r *IPRateLimiter) track(shard *ipShard, key string, w *accessWindow) {
+	delta := 1
+	if shard.lru != nil {
+		for len(shard.accessMap) >= shard.maxKeys {
+			oldest := shard.lru.Back().Value.(string)
+			shard.remove(oldest, shard.accessMap[oldest])
+			delta--
+			if r.keys.OnEvict != nil {
+				r.keys.OnEvict()
+			}
 		}
+		w.elem = shard.lru.PushFront(key)
+	}
+	shard.accessMap[key] = w
+	r.tracked(delta)
+}
+
+// tracked reports a change of the number of tracked keys
+func (r *IPRateLimiter) tracked(delta int) {
+	if delta != 0 && r.keys.OnTracked != nil {
+		r.keys.OnTracked(delta)
+	}
+}
+
+// touch marks a key as recently used
+func (s *ipShard) touch(w *accessWindow) {
+	if s.lru != nil {
+		s.lru.MoveToFront(w.elem)
+	}
+}
+
+// remove stops tracking a key
+func (s *ipShard) remove(key string, w *accessWindow) {
+	delete(s.accessMap, key)
+	if s.lru != nil {
+		s.lru.Remove(w.elem)
 	}
 }
 
 // CheckLimit zkontroluje, zda IP adresa překročila limit požadavků - optimalizováno
 func (r *IPRateLimiter) CheckLimit(ipAddress string) bool {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	return !r.DecideN(ipAddress, 1).Allowed
+}
+
+// DecideN records n accesses for the IP address when they are within the limit
+func (r *IPRateLimiter) DecideN(ipAddress string, n int) Decision {
+	shard := r.shard(ipAddress)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
 	now := time.Now()
 	cutoffTime := now.Add(-time.Duration(r.windowSecs) * time.Second)
 
 	// Získat historii přístupů pro tuto IP
-	window, exists := r.accessMap[ipAddress]
+	w, exists := shard.accessMap[ipAddress]
 
 	// Pokud není historie, vytvořit nový záznam
 	if !exists {
-		window = newAccessWindow(r.maxRequests + 10) // Buffer for better performance
-		r.accessMap[ipAddress] = window
+		w = newAccessWindow(r.maxRequests + 10) // Buffer for better performance
+		r.track(shard, ipAddress, w)
+	} else {
+		shard.touch(w)
 	}
 
 	// Fast cleanup for this specific window if needed
-	if window.lastCleanup.Add(time.Duration(r.windowSecs/4) * time.Second).Before(now) {
-		window.cleanup(cutoffTime)
+	if w.lastCleanup.Add(time.Duration(r.windowSecs/4) * time.Second).Before(now) {
+		w.cleanup(cutoffTime)
+	}
+
+	decision := r.decide(w, n, now)
+	if decision.Allowed {
+		for range n {
+			w.add(now)
+		}
+	}
+	return decision
+}
+
+// PeekN checks n accesses for the IP address without recording them
+func (r *IPRateLimiter) PeekN(ipAddress string, n int) Decision {
+	shard := r.shard(ipAddress)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return r.decide(shard.accessMap[ipAddress], n, time.Now())
+}
+
+// decide decides whether n more accesses fit into the window w, nil for an unknown IP address
+func (r *IPRateLimiter) decide(w *accessWindow, n int, now time.Time) Decision {
+	window := time.Duration(r.windowSecs) * time.Second
+	cutoffTime := now.Add(-window)
+
+	validCount := 0
+	if w != nil {
+		validCount = w.countValid(cutoffTime)
+	}
+
+	// The accesses of an allowed request become the newest ones
+	if validCount+n <= r.maxRequests {
+		return Decision{
+			Allowed:   true,
+			Limit:     r.maxRequests,
+			Remaining: r.maxRequests - validCount - n,
+			ResetAt:   now.Add(window),
+		}
 	}
 
-	// Count valid requests
-	validCount := window.countValid(cutoffTime)
+	// Limit exceeded, the full limit is back once the newest access leaves the window and the
+	// request may be retried once enough of the oldest ones do
+	decision := Decision{Limit: r.maxRequests, Remaining: max(r.maxRequests-validCount, 0), ResetAt: now.Add(window), RetryAfter: window}
+	if w == nil {
+		return decision
+	}
+	if newest, ok := w.newest(); ok && newest.After(cutoffTime) {
+		decision.ResetAt = newest.Add(window)
+	}
+	if freed, ok := w.nthValid(cutoffTime, validCount+n-r.maxRequests-1); ok {
+		decision.RetryAfter = freed.Add(window).Sub(now)
+	}
+	return decision
+}
 
-	// Add current access
-	window.add(now)
+// Snapshot writes the accesses still inside the time window of every IP address
+func (r *IPRateLimiter) Snapshot(w io.Writer) error {
+	cutoffTime := time.Now().Add(-time.Duration(r.windowSecs) * time.Second)
+	var entries []snapshotEntry
+	for _, shard := range r.shards {
+		shard.mu.RLock()
+		for ip, window := range shard.accessMap {
+			var accesses []int64
+			for _, t := range window.validAccesses(cutoffTime) {
+				accesses = append(accesses, t.UnixNano())
+			}
+			if len(accesses) > 0 {
+				entries = append(entries, snapshotEntry{key: ip, values: accesses})
+			}
+		}
+		shard.mu.RUnlock()
+	}
 
-	// Check if limit exceeded
-	return validCount >= r.maxRequests
+	sw := newSnapshotWriter(snapshotSlidingLog, len(entries))
+	for _, e := range entries {
+		sw.entry(e.key, e.values...)
+	}
+	return sw.writeTo(w)
 }
 
-// Close gracefully shuts down the rate limiter
-func (r *IPRateLimiter) Close() error {
-	close(r.cleanupDone)
+// Restore loads accesses written by Snapshot, dropping those outside the time window
+func (r *IPRateLimiter) Restore(rd io.Reader) error {
+	entries, err := readSnapshot(rd, snapshotSlidingLog, 0)
+	if err != nil {
+		return err
+	}
+
+	// Restore the least recently used keys first so a bounded limiter evicts them first
+	newest := func(e snapshotEntry) int64 {
+		if len(e.values) == 0 {
+			return 0
+		}
+		return e.values[len(e.values)-1]
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return newest(entries[i]) < newest(entries[j])
+	})
+
+	cutoffTime := time.Now().Add(-time.Duration(r.windowSecs) * time.Second)
+	for _, e := range entries {
+		// Only the most recent maxRequests accesses can influence a decision
+		accesses := e.values
+		if len(accesses) > r.maxRequests {
+			accesses = accesses[len(accesses)-r.maxRequests:]
+		}
+
+		window := newAccessWindow(r.maxRequests + 10)
+		for _, nanos := range accesses {
+			if t := time.Unix(0, nanos); t.After(cutoffTime) {
+				window.add(t)
+			}
+		}
+		if window.count == 0 {
+			continue
+		}
+
+		shard := r.shard(e.key)
+		shard.mu.Lock()
+		if existing, exists := shard.accessMap[e.key]; exists {
+			shard.remove(e.key, existing)
+			r.tracked(-1)
+		}
+		r.track(shard, e.key, window)
+		shard.mu.Unlock()
+	}
 	return nil
 }
@@ -1,11 +1,32 @@
 package storage
 
 import (
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// window returns the access window of a key, nil when it is not tracked
+func (r *IPRateLimiter) window(key string) *accessWindow {
+	shard := r.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.accessMap[key]
+}
+
+// keyCount returns the number of keys tracked over all shards
+func (r *IPRateLimiter) keyCount() int {
+	count := 0
+	for _, shard := range r.shards {
+		shard.mu.RLock()
+		count += len(shard.accessMap)
+		shard.mu.RUnlock()
+	}
+	return count
+}
+
 func TestIPRateLimiter_Basic(t *testing.T) {
 	limiter := NewIPRateLimiter(1, 2) // 2 requests per 1 second
 	defer limiter.Close()
@@ -99,7 +120,7 @@ func TestIPRateLimiter_CircularBuffer(t *testing.T) {
 	}
 
 	// Verify buffer state is consistent
-	window := limiter.accessMap[ip]
+	window := limiter.window(ip)
 	if window.count > window.capacity {
 		t.Errorf("Buffer overflow: count %d > capacity %d", window.count, window.capacity)
 	}
@@ -159,8 +180,8 @@ func TestIPRateLimiter_Cleanup(t *testing.T) {
 	}
 
 	// Verify entries exist
-	if len(limiter.accessMap) != 3 {
-		t.Errorf("Expected 3 entries, got %d", len(limiter.accessMap))
+	if n := limiter.keyCount(); n != 3 {
+		t.Errorf("Expected 3 entries, got %d", n)
 	}
 
 	// Wait for cleanup
@@ -169,16 +190,132 @@ func TestIPRateLimiter_Cleanup(t *testing.T) {
 	// Trigger cleanup manually
 	limiter.cleanup()
 
-	// Entries should be cleaned up or have reduced count
-	cleanedEntries := 0
-	for _, window := range limiter.accessMap {
-		if window.count == 0 {
-			cleanedEntries++
+	// Expired entries are removed from every shard
+	if n := limiter.keyCount(); n != 0 {
+		t.Errorf("Expected expired entries to be cleaned up, %d left", n)
+	}
+}
+
+func TestIPRateLimiter_Decide(t *testing.T) {
+	limiter := NewIPRateLimiter(10, 2) // 2 requests per 10 seconds
+	defer limiter.Close()
+
+	first := limiter.DecideN("192.168.1.1", 1)
+	if !first.Allowed || first.Limit != 2 || first.Remaining != 1 {
+		t.Errorf("Unexpected first decision: %+v", first)
+	}
+
+	second := limiter.DecideN("192.168.1.1", 1)
+	if !second.Allowed || second.Remaining != 0 {
+		t.Errorf("Unexpected second decision: %+v", second)
+	}
+
+	third := limiter.DecideN("192.168.1.1", 1)
+	if third.Allowed || third.Remaining != 0 {
+		t.Errorf("Unexpected third decision: %+v", third)
+	}
+	if third.RetryAfter <= 9*time.Second || third.RetryAfter > 10*time.Second {
+		t.Errorf("Expected retry after close to 10s, got %v", third.RetryAfter)
+	}
+
+	// Rejected requests are not recorded
+	if window := limiter.window("192.168.1.1"); window.count != 2 {
+		t.Errorf("Expected 2 recorded accesses, got %d", window.count)
+	}
+}
+
+func TestIPRateLimiter_RetryAfterRejection(t *testing.T) {
+	limiter := NewIPRateLimiter(1, 2) // 2 requests per 1 second
+	defer limiter.Close()
+
+	ip := "192.168.1.1"
+	limiter.CheckLimit(ip)
+	limiter.CheckLimit(ip)
+
+	// Retrying while blocked does not push the window further out
+	for i := 0; i < 5; i++ {
+		if !limiter.CheckLimit(ip) {
+			t.Fatalf("Request %d should exceed limit", i+1)
 		}
 	}
 
-	if cleanedEntries == 0 {
-		t.Error("Expected some entries to be cleaned up")
+	time.Sleep(1100 * time.Millisecond)
+	if limiter.CheckLimit(ip) {
+		t.Error("Request after the window passed should not exceed limit")
+	}
+}
+
+func TestIPRateLimiter_DecideN(t *testing.T) {
+	limiter := NewIPRateLimiter(10, 10) // 10 units per 10 seconds
+	defer limiter.Close()
+
+	if d := limiter.DecideN("192.168.1.1", 5); !d.Allowed || d.Remaining != 5 {
+		t.Errorf("Unexpected decision for cost 5: %+v", d)
+	}
+
+	// Not enough units left, the rejected request consumes nothing
+	denied := limiter.DecideN("192.168.1.1", 6)
+	if denied.Allowed || denied.Remaining != 5 || denied.RetryAfter <= 9*time.Second {
+		t.Errorf("Expected cost 6 to be rejected until the window passes, got %+v", denied)
+	}
+
+	if d := limiter.DecideN("192.168.1.1", 5); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("Expected the remaining 5 units to pass, got %+v", d)
+	}
+}
+
+func TestIPRateLimiter_PeekMatchesDecide(t *testing.T) {
+	limiter := NewIPRateLimiter(10, 2) // 2 requests per 10 seconds
+	defer limiter.Close()
+
+	limiter.DecideN("192.168.1.1", 1)
+	time.Sleep(20 * time.Millisecond)
+	limiter.DecideN("192.168.1.1", 1)
+
+	// A rejection does not change the window, so checking and deciding agree
+	peeked := limiter.PeekN("192.168.1.1", 1)
+	decided := limiter.DecideN("192.168.1.1", 1)
+	if peeked.Allowed || decided.Allowed {
+		t.Fatalf("Expected both to reject, got %+v and %+v", peeked, decided)
+	}
+	if !peeked.ResetAt.Equal(decided.ResetAt) || peeked.Remaining != decided.Remaining {
+		t.Errorf("Expected the same decision, got %+v and %+v", peeked, decided)
+	}
+	if diff := peeked.RetryAfter - decided.RetryAfter; diff < 0 || diff > 10*time.Millisecond {
+		t.Errorf("Expected the same retry after, got %v and %v", peeked.RetryAfter, decided.RetryAfter)
+	}
+}
+
+func TestIPRateLimiter_MaxKeys(t *testing.T) {
+	evicted, tracked := 0, 0
+	limiter := NewBoundedIPRateLimiter(10, 1, KeyLimitOptions{
+		MaxKeys:   2,
+		OnEvict:   func() { evicted++ },
+		OnTracked: func(delta int) { tracked += delta },
+	})
+	defer limiter.Close()
+
+	limiter.CheckLimit("192.168.1.1")
+	limiter.CheckLimit("192.168.1.2")
+
+	// Touch the first key so the second one is the least recently used
+	if !limiter.CheckLimit("192.168.1.1") {
+		t.Error("Second request of the first IP should exceed limit")
+	}
+
+	limiter.CheckLimit("192.168.1.3")
+
+	if n := limiter.keyCount(); n != 2 || tracked != 2 {
+		t.Errorf("Expected 2 tracked keys, got %d (reported %d)", n, tracked)
+	}
+	if evicted != 1 {
+		t.Errorf("Expected 1 eviction, got %d", evicted)
+	}
+	if limiter.window("192.168.1.2") != nil {
+		t.Error("Least recently used key should have been evicted")
+	}
+	if !limiter.CheckLimit("192.168.1.1") {
+		t.Error("Recently used key should keep its state")
 	}
 }
 
@@ -267,3 +404,29 @@ func BenchmarkIPRateLimiter_Concurrent(b *testing.B) {
 		}
 	})
 }
+
+// BenchmarkIPRateLimiter_ParallelShards shows how throughput scales with the
+// number of shards when many goroutines check different IP addresses
+func BenchmarkIPRateLimiter_ParallelShards(b *testing.B) {
+	for _, shards := range []int{1, 4, ipRateLimiterShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			limiter := newShardedIPRateLimiter(60, 1000, shards, KeyLimitOptions{})
+			defer limiter.Close()
+
+			ips := make([]string, 1024)
+			for i := range ips {
+				ips[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+			}
+
+			var worker atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(worker.Add(1)) * 97
+				for pb.Next() {
+					limiter.CheckLimit(ips[i%len(ips)])
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// RedisLimiter is a sliding window counter limiter keeping its counters in a
+// Redis compatible server, so all proxy replicas share the same limits
+type RedisLimiter struct {
+	client      *RedisClient
+	prefix      string // Key namespace of this limiter
+	window      time.Duration
+	maxRequests int
+	failOpen    bool             // Allow requests when the server is unreachable
+	now         func() time.Time // Clock, replaceable in tests
+}
+
+// NewRedisLimiter creates a limiter allowing maxRequests per windowSeconds, keys are stored under prefix
+func NewRedisLimiter(client *RedisClient, prefix string, windowSeconds, maxRequests int, failOpen bool) *RedisLimiter {
+	return &RedisLimiter{
+		client:      client,
+		prefix:      prefix,
+		window:      time.Duration(windowSeconds) * time.Second,
+		maxRequests: maxRequests,
+		failOpen:    failOpen,
+		now:         time.Now,
+	}
+}
+
+// DecideN counts n requests in the current window, undone again when they exceed the limit
+func (r *RedisLimiter) DecideN(key string, n int) Decision {
+	now := r.now().UnixNano()
+	window := int64(r.window)
+	index := now / window
+
+	current := r.prefix + key + ":" + strconv.FormatInt(index, 10)
+	previous := r.prefix + key + ":" + strconv.FormatInt(index-1, 10)
+
+	replies, err := r.client.Do(
+		[]string{"MULTI"},
+		[]string{"INCRBY", current, strconv.Itoa(n)},
+		[]string{"PEXPIRE", current, strconv.FormatInt(2*r.window.Milliseconds(), 10)},
+		[]string{"GET", previous},
+		[]string{"EXEC"},
+	)
+	if err != nil {
+		return r.failure(err)
+	}
+
+	results, ok := replies[len(replies)-1].([]any)
+	if !ok || len(results) != 3 {
+		return r.failure(fmt.Errorf("unexpected EXEC reply %v", replies[len(replies)-1]))
+	}
+	currentCount, err := replyInt(results[0])
+	if err != nil {
+		return r.failure(err)
+	}
+	previousCount, err := replyInt(results[2])
+	if err != nil {
+		return r.failure(err)
+	}
+
+	counter := windowCounter{index: index, current: int(currentCount), previous: int(previousCount)}
+	elapsed := float64(now%window) / float64(window)
+	estimate := float64(counter.previous)*(1-elapsed) + float64(counter.current)
+
+	decision := Decision{Limit: r.maxRequests, ResetAt: time.Unix(0, (index+2)*window)}
+
+	if estimate > float64(r.maxRequests) {
+		// Give the slot back, the request is rejected
+		if _, err := r.client.Do([]string{"DECRBY", current, strconv.Itoa(n)}); err != nil {
+			log.Printf("Redis limiter %s: failed to release rejected request: %v", r.prefix, err)
+		}
+		counter.current -= n
+		decision.Remaining = max(int(float64(r.maxRequests)-estimate)+n, 0)
+		decision.RetryAfter = slidingWindowRetryAfter(&counter, now, window, r.maxRequests, n)
+		return decision
+	}
+
+	decision.Allowed = true
+	decision.Remaining = int(float64(r.maxRequests) - estimate)
+	return decision
+}
+
+// PeekN checks n requests against the current counts without counting them
+func (r *RedisLimiter) PeekN(key string, n int) Decision {
+	now := r.now().UnixNano()
+	window := int64(r.window)
+	index := now / window
+
+	replies, err := r.client.Do(
+		[]string{"GET", r.prefix + key + ":" + strconv.FormatInt(index, 10)},
+		[]string{"GET", r.prefix + key + ":" + strconv.FormatInt(index-1, 10)},
+	)
+	if err != nil {
+		return r.failure(err)
+	}
+	currentCount, err := replyInt(replies[0])
+	if err != nil {
+		return r.failure(err)
+	}
+	previousCount, err := replyInt(replies[1])
+	if err != nil {
+		return r.failure(err)
+	}
+
+	counter := windowCounter{index: index, current: int(currentCount), previous: int(previousCount)}
+	elapsed := float64(now%window) / float64(window)
+	estimate := float64(counter.previous)*(1-elapsed) + float64(counter.current)
+
+	decision := Decision{Limit: r.maxRequests, ResetAt: time.Unix(0, (index+2)*window)}
+
+	if estimate+float64(n) > float64(r.maxRequests) {
+		decision.Remaining = max(int(float64(r.maxRequests)-estimate), 0)
+		decision.RetryAfter = slidingWindowRetryAfter(&counter, now, window, r.maxRequests, n)
+		return decision
+	}
+
+	decision.Allowed = true
+	decision.Remaining = int(float64(r.maxRequests) - estimate - float64(n))
+	return decision
+}
+
+// failure applies the configured policy when the server cannot be reached
+func (r *RedisLimiter) failure(err error) Decision {
+	if r.failOpen {
+		log.Printf("Redis limiter %s: %v (failing open)", r.prefix, err)
+		return Decision{Allowed: true, Limit: -1, Remaining: -1}
+	}
+
+	log.Printf("Redis limiter %s: %v (failing closed)", r.prefix, err)
+	return Decision{Limit: r.maxRequests, RetryAfter: time.Second, ResetAt: r.now().Add(time.Second)}
+}
+
+// Close is a no-op, the client is shared between limiters and closed by its owner
+func (r *RedisLimiter) Close() error {
+	return nil
+}
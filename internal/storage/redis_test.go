@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respServer is an in-process stand-in for Redis implementing the commands used by RedisLimiter
+type respServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	data     map[string]int64
+	password string
+	commands int
+	delay    time.Duration // Time taken by every command, lets concurrent requests overlap
+	open     int           // Currently open connections
+	peakOpen int           // Most connections open at the same time
+}
+
+func newRESPServer(t *testing.T, password string) *respServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	s := &respServer{listener: listener, data: make(map[string]int64), password: password}
+	go s.serve()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *respServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *respServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *respServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.open++
+	s.peakOpen = max(s.peakOpen, s.open)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.open--
+		s.mu.Unlock()
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	authenticated := s.password == ""
+	var queue [][]string
+	inMulti := false
+
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		values, _ := reply.([]any)
+		cmd := make([]string, len(values))
+		for i, v := range values {
+			cmd[i], _ = v.(string)
+		}
+		name := strings.ToUpper(cmd[0])
+
+		switch {
+		case name == "AUTH":
+			authenticated = cmd[1] == s.password
+			if authenticated {
+				w.WriteString("+OK\r\n")
+			} else {
+				w.WriteString("-WRONGPASS invalid password\r\n")
+			}
+		case !authenticated:
+			w.WriteString("-NOAUTH Authentication required\r\n")
+		case name == "MULTI":
+			inMulti = true
+			queue = nil
+			w.WriteString("+OK\r\n")
+		case name == "EXEC":
+			inMulti = false
+			fmt.Fprintf(w, "*%d\r\n", len(queue))
+			for _, queued := range queue {
+				w.WriteString(s.exec(queued))
+			}
+		case inMulti:
+			queue = append(queue, cmd)
+			w.WriteString("+QUEUED\r\n")
+		default:
+			w.WriteString(s.exec(cmd))
+		}
+		w.Flush()
+	}
+}
+
+// exec runs a single command and returns its encoded reply
+func (s *respServer) exec(cmd []string) string {
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands++
+
+	switch strings.ToUpper(cmd[0]) {
+	case "PING", "SELECT", "PEXPIRE":
+		return "+OK\r\n"
+	case "INCR":
+		s.data[cmd[1]]++
+		return ":" + strconv.FormatInt(s.data[cmd[1]], 10) + "\r\n"
+	case "DECR":
+		s.data[cmd[1]]--
+		return ":" + strconv.FormatInt(s.data[cmd[1]], 10) + "\r\n"
+	case "INCRBY", "DECRBY":
+		n, _ := strconv.ParseInt(cmd[2], 10, 64)
+		if strings.ToUpper(cmd[0]) == "DECRBY" {
+			n = -n
+		}
+		s.data[cmd[1]] += n
+		return ":" + strconv.FormatInt(s.data[cmd[1]], 10) + "\r\n"
+	case "GET":
+		value, ok := s.data[cmd[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		v := strconv.FormatInt(value, 10)
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func TestRedisLimiter_SharedBetweenReplicas(t *testing.T) {
+	server := newRESPServer(t, "secret")
+	clock := newFakeClock()
+
+	// Two replicas with their own client share the same counters
+	var replicas []*RedisLimiter
+	for i := 0; i < 2; i++ {
+		client := NewRedisClient(RedisOptions{Address: server.addr(), Password: "secret", PoolSize: 2})
+		defer client.Close()
+		limiter := NewRedisLimiter(client, "rlsp:test:", 10, 3, false)
+		limiter.now = clock.Now
+		replicas = append(replicas, limiter)
+	}
+
+	expected := []bool{false, false, false, true, true}
+	for i, want := range expected {
+		if got := exceeded(replicas[i%2], "192.168.1.1"); got != want {
+			t.Errorf("Request %d: expected exceeded=%v, got %v", i+1, want, got)
+		}
+	}
+
+	// Rejected requests are given back
+	if got := server.data["rlsp:test:192.168.1.1:"+strconv.FormatInt(clock.Now().UnixNano()/int64(10*time.Second), 10)]; got != 3 {
+		t.Errorf("Expected counter 3, got %d", got)
+	}
+
+	// Other keys are independent
+	if exceeded(replicas[0], "192.168.1.2") {
+		t.Error("Different IP should not exceed limit")
+	}
+}
+
+func TestRedisLimiter_Decide(t *testing.T) {
+	server := newRESPServer(t, "")
+	clock := newFakeClock()
+
+	client := NewRedisClient(RedisOptions{Address: server.addr()})
+	defer client.Close()
+	limiter := NewRedisLimiter(client, "rlsp:", 10, 2, false)
+	limiter.now = clock.Now
+
+	first := limiter.DecideN("a", 1)
+	if !first.Allowed || first.Limit != 2 || first.Remaining != 1 {
+		t.Errorf("Unexpected first decision: %+v", first)
+	}
+
+	limiter.DecideN("a", 1)
+	denied := limiter.DecideN("a", 1)
+	if denied.Allowed || denied.RetryAfter != 15*time.Second {
+		t.Errorf("Unexpected denied decision: %+v", denied)
+	}
+
+	// Half way through the next window one slot is free again
+	clock.Advance(15 * time.Second)
+	if !limiter.DecideN("a", 1).Allowed {
+		t.Error("Expected request after retry-after to pass")
+	}
+}
+
+func TestRedisLimiter_FailurePolicy(t *testing.T) {
+	// Reserve an address nobody listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	client := NewRedisClient(RedisOptions{Address: addr, Timeout: 100 * time.Millisecond})
+	defer client.Close()
+
+	if open := NewRedisLimiter(client, "rlsp:", 1, 1, true); !open.DecideN("a", 1).Allowed {
+		t.Error("Fail-open limiter should allow requests when the server is unreachable")
+	}
+	if closed := NewRedisLimiter(client, "rlsp:", 1, 1, false); closed.DecideN("a", 1).Allowed {
+		t.Error("Fail-closed limiter should reject requests when the server is unreachable")
+	}
+}
+
+func TestRedisClient_Pool(t *testing.T) {
+	server := newRESPServer(t, "")
+	server.delay = 5 * time.Millisecond
+	client := NewRedisClient(RedisOptions{Address: server.addr(), PoolSize: 2})
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Do([]string{"INCR", "counter"}); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.peakOpen != 2 {
+		t.Errorf("Expected the pool to use exactly 2 concurrent connections, peak was %d", server.peakOpen)
+	}
+	if server.data["counter"] != 20 {
+		t.Errorf("Expected counter 20, got %d", server.data["counter"])
+	}
+}
+
+func TestRedisLimiter_PeekN(t *testing.T) {
+	server := newRESPServer(t, "")
+	clock := newFakeClock()
+
+	client := NewRedisClient(RedisOptions{Address: server.addr()})
+	defer client.Close()
+	limiter := NewRedisLimiter(client, "rlsp:", 10, 2, false)
+	limiter.now = clock.Now
+
+	for i := 0; i < 3; i++ {
+		if d := limiter.PeekN("a", 1); !d.Allowed || d.Remaining != 1 {
+			t.Fatalf("Peek %d: unexpected decision %+v", i+1, d)
+		}
+	}
+	if len(server.data) != 0 {
+		t.Errorf("Peeking should not write counters, got %v", server.data)
+	}
+
+	limiter.DecideN("a", 2)
+	if d := limiter.PeekN("a", 1); d.Allowed || d.RetryAfter != 15*time.Second {
+		t.Errorf("Unexpected decision after the quota is used up: %+v", d)
+	}
+}
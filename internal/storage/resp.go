@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RedisOptions configures the connection to a Redis compatible server
+type RedisOptions struct {
+	Address  string
+	Password string
+	DB       int
+	PoolSize int           // Maximum number of open connections
+	Timeout  time.Duration // Dial, read and write timeout
+}
+
+// RedisClient is a minimal pooled client speaking the Redis protocol (RESP)
+type RedisClient struct {
+	opts  RedisOptions
+	idle  chan *redisConn // Idle connections ready for reuse
+	slots chan struct{}   // One token per allowed open connection
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// NewRedisClient creates a client, connections are opened lazily
+func NewRedisClient(opts RedisOptions) *RedisClient {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 10
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 500 * time.Millisecond
+	}
+
+	return &RedisClient{
+		opts:  opts,
+		idle:  make(chan *redisConn, opts.PoolSize),
+		slots: make(chan struct{}, opts.PoolSize),
+	}
+}
+
+// Do sends the commands in a single round trip and returns their replies.
+// Error replies are returned as values so MULTI/EXEC sequences can be inspected.
+func (c *RedisClient) Do(cmds ...[]string) ([]any, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := conn.do(cmds, c.opts.Timeout)
+	if err != nil {
+		// Connection state is unknown after an I/O error
+		c.discard(conn)
+		return nil, err
+	}
+
+	c.put(conn)
+	return replies, nil
+}
+
+// get returns an idle connection or dials a new one when the pool has room
+func (c *RedisClient) get() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	timer := time.NewTimer(c.opts.Timeout)
+	defer timer.Stop()
+
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	case c.slots <- struct{}{}:
+		conn, err := c.dial()
+		if err != nil {
+			<-c.slots
+			return nil, err
+		}
+		return conn, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("redis: timed out waiting for a free connection")
+	}
+}
+
+func (c *RedisClient) put(conn *redisConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		c.discard(conn)
+	}
+}
+
+func (c *RedisClient) discard(conn *redisConn) {
+	conn.conn.Close()
+	<-c.slots
+}
+
+// dial opens a connection and authenticates it
+func (c *RedisClient) dial() (*redisConn, error) {
+	netConn, err := net.DialTimeout("tcp", c.opts.Address, c.opts.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	conn := &redisConn{
+		conn: netConn,
+		r:    bufio.NewReader(netConn),
+		w:    bufio.NewWriter(netConn),
+	}
+
+	var setup [][]string
+	if c.opts.Password != "" {
+		setup = append(setup, []string{"AUTH", c.opts.Password})
+	}
+	if c.opts.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.opts.DB)})
+	}
+	if len(setup) > 0 {
+		replies, err := conn.do(setup, c.opts.Timeout)
+		if err == nil {
+			for _, reply := range replies {
+				if e, ok := reply.(redisError); ok {
+					err = e
+					break
+				}
+			}
+		}
+		if err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("redis: connection setup failed: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// Close closes all idle connections
+func (c *RedisClient) Close() error {
+	for {
+		select {
+		case conn := <-c.idle:
+			c.discard(conn)
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *redisConn) do(cmds [][]string, timeout time.Duration) ([]any, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range cmds {
+		fmt.Fprintf(c.w, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(cmds))
+	for i := range cmds {
+		reply, err := readReply(c.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// readReply reads a single RESP value: string, int64, nil, redisError or []any
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return redisError(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", payload)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", payload)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		values := make([]any, size)
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
+
+// replyInt converts an integer or numeric bulk reply to int64, nil counts as zero
+func replyInt(reply any) (int64, error) {
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case nil:
+		return 0, nil
+	case redisError:
+		return 0, v
+	default:
+		return 0, fmt.Errorf("redis: unexpected reply %T", reply)
+	}
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// SlidingWindowLimiter approximates a sliding window by weighting the count of
+// the previous fixed window with the part of it still covered by the sliding one.
+// It keeps two counters per key, so large windows (daily quotas) stay cheap.
+type SlidingWindowLimiter struct {
+	mu          sync.Mutex
+	counters    map[string]*windowCounter // key -> counters
+	window      time.Duration             // Length of a fixed window
+	windowSecs  int                       // Time window in seconds
+	maxRequests int                       // Maximum number of requests in the window
+	now         func() time.Time          // Clock, replaceable in tests
+	*cleanupLoop
+}
+
+// windowCounter holds the request counts of the current and previous fixed window
+type windowCounter struct {
+	index    int64 // Index of the current fixed window since the unix epoch
+	current  int
+	previous int
+}
+
+// NewSlidingWindowLimiter creates a sliding window counter limiter allowing maxRequests per windowSeconds
+func NewSlidingWindowLimiter(windowSeconds, maxRequests int) *SlidingWindowLimiter {
+	limiter := &SlidingWindowLimiter{
+		counters:    make(map[string]*windowCounter),
+		window:      time.Duration(windowSeconds) * time.Second,
+		windowSecs:  windowSeconds,
+		maxRequests: maxRequests,
+		now:         time.Now,
+	}
+	limiter.cleanupLoop = startCleanup(cleanupInterval(limiter.window), limiter.cleanup)
+
+	return limiter
+}
+
+// advance moves the counter to the fixed window with the given index
+func (c *windowCounter) advance(index int64) {
+	switch {
+	case index == c.index:
+		return
+	case index == c.index+1:
+		c.previous = c.current
+	default:
+		c.previous = 0
+	}
+	c.current = 0
+	c.index = index
+}
+
+// cleanup removes keys with no requests in the current or previous window
+func (r *SlidingWindowLimiter) cleanup() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	index := r.now().UnixNano() / int64(r.window)
+	for key, counter := range r.counters {
+		if counter.index < index-1 {
+			delete(r.counters, key)
+		}
+	}
+}
+
+// DecideN records n requests for the key unless the weighted count would exceed the limit
+func (r *SlidingWindowLimiter) DecideN(key string, n int) Decision {
+	return r.decide(key, n, true)
+}
+
+// PeekN checks n requests for the key without recording them
+func (r *SlidingWindowLimiter) PeekN(key string, n int) Decision {
+	return r.decide(key, n, false)
+}
+
+// decide checks n requests for the key, recording them when allowed and record is set
+func (r *SlidingWindowLimiter) decide(key string, n int, record bool) Decision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now().UnixNano()
+	window := int64(r.window)
+	index := now / window
+
+	counter, exists := r.counters[key]
+	if !exists {
+		counter = &windowCounter{index: index}
+		if record {
+			r.counters[key] = counter
+		}
+	}
+	counter.advance(index)
+
+	// Weight of the previous window is the part still inside the sliding window
+	elapsed := float64(now%window) / float64(window)
+	estimate := float64(counter.previous)*(1-elapsed) + float64(counter.current)
+
+	decision := Decision{Limit: r.maxRequests}
+
+	if estimate+float64(n) > float64(r.maxRequests) {
+		decision.RetryAfter = slidingWindowRetryAfter(counter, now, window, r.maxRequests, n)
+	} else {
+		if record {
+			counter.current += n
+		}
+		estimate += float64(n)
+		decision.Allowed = true
+	}
+
+	decision.Remaining = int(float64(r.maxRequests) - estimate)
+	if decision.Remaining < 0 {
+		decision.Remaining = 0
+	}
+
+	// Requests of the current window stop counting at the end of the next one
+	resetIndex := index + 1
+	if counter.current > 0 {
+		resetIndex++
+	}
+	decision.ResetAt = time.Unix(0, resetIndex*window)
+	return decision
+}
+
+// SetLimit changes the maximum number of requests in the window, requests counted so far are kept
+func (r *SlidingWindowLimiter) SetLimit(maxRequests int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.maxRequests = maxRequests
+}
+
+// slidingWindowRetryAfter returns how long until the weighted count leaves room for n more requests
+func slidingWindowRetryAfter(counter *windowCounter, now, window int64, maxRequests, n int) time.Duration {
+	windowStart := counter.index * window
+	free := float64(max(maxRequests-n, 0))
+
+	// Room frees up within the current window once enough of the previous one slides out
+	if float64(counter.current) <= free && counter.previous > 0 {
+		weight := 1 - (free-float64(counter.current))/float64(counter.previous)
+		return time.Duration(windowStart + int64(weight*float64(window)) - now)
+	}
+
+	// Otherwise wait until the current window becomes the previous one and slides out enough
+	if counter.current == 0 {
+		return time.Duration(windowStart + window - now)
+	}
+	weight := 1 - free/float64(counter.current)
+	if weight < 0 {
+		weight = 0
+	}
+	return time.Duration(windowStart + window + int64(weight*float64(window)) - now)
+}
+
+// Snapshot writes the counters of every key
+func (r *SlidingWindowLimiter) Snapshot(w io.Writer) error {
+	r.mu.Lock()
+	sw := newSnapshotWriter(snapshotSlidingWindow, len(r.counters))
+	for key, counter := range r.counters {
+		sw.entry(key, counter.index, int64(counter.current), int64(counter.previous))
+	}
+	r.mu.Unlock()
+
+	return sw.writeTo(w)
+}
+
+// Restore loads counters written by Snapshot, those older than the previous window are dropped
+func (r *SlidingWindowLimiter) Restore(rd io.Reader) error {
+	entries, err := readSnapshot(rd, snapshotSlidingWindow, 3)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	index := r.now().UnixNano() / int64(r.window)
+	for _, e := range entries {
+		counter := &windowCounter{index: e.values[0], current: int(e.values[1]), previous: int(e.values[2])}
+		if counter.index >= index-1 && counter.index <= index {
+			r.counters[e.key] = counter
+		}
+	}
+	return nil
+}
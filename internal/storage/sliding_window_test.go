@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	tests := []struct {
+		name        string
+		windowSecs  int
+		maxRequests int
+		steps       []step
+	}{
+		{
+			name:        "allows max requests in window",
+			windowSecs:  10,
+			maxRequests: 4,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+			},
+		},
+		{
+			name:        "previous window is weighted",
+			windowSecs:  10,
+			maxRequests: 4,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				// Start of the next window, previous still counts fully
+				{advance: 10 * time.Second, key: "a", exceeded: true},
+				// Half way, previous counts as 2
+				{advance: 5 * time.Second, key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+			},
+		},
+		{
+			name:        "idle key starts over",
+			windowSecs:  10,
+			maxRequests: 2,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+				{advance: 20 * time.Second, key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+			},
+		},
+		{
+			name:        "daily quota",
+			windowSecs:  86400,
+			maxRequests: 3,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{advance: 6 * time.Hour, key: "a", exceeded: false},
+				{advance: 6 * time.Hour, key: "a", exceeded: false},
+				{advance: 6 * time.Hour, key: "a", exceeded: true},
+				// Next day at noon, half of yesterday's 3 requests still count
+				{advance: 18 * time.Hour, key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+			},
+		},
+		{
+			name:        "keys are independent",
+			windowSecs:  1,
+			maxRequests: 1,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{key: "b", exceeded: false},
+				{key: "a", exceeded: true},
+				{key: "b", exceeded: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter := NewSlidingWindowLimiter(tt.windowSecs, tt.maxRequests)
+			limiter.now = clock.Now
+			defer limiter.Close()
+
+			for i, s := range tt.steps {
+				clock.Advance(s.advance)
+				if got := exceeded(limiter, s.key); got != s.exceeded {
+					t.Errorf("step %d (%s): expected exceeded=%v, got %v", i, s.key, s.exceeded, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSlidingWindowLimiter_Decide(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewSlidingWindowLimiter(10, 4)
+	limiter.now = clock.Now
+	defer limiter.Close()
+
+	first := limiter.DecideN("a", 1)
+	if !first.Allowed || first.Limit != 4 || first.Remaining != 3 {
+		t.Errorf("Unexpected first decision: %+v", first)
+	}
+	if want := clock.Now().Add(20 * time.Second); !first.ResetAt.Equal(want) {
+		t.Errorf("Expected reset at %v, got %v", want, first.ResetAt)
+	}
+
+	for i := 0; i < 3; i++ {
+		limiter.DecideN("a", 1)
+	}
+
+	// Full window: room frees once a quarter of it has slid out of the next window
+	clock.Advance(5 * time.Second)
+	denied := limiter.DecideN("a", 1)
+	if denied.Allowed || denied.RetryAfter != 7500*time.Millisecond {
+		t.Errorf("Unexpected denied decision: %+v", denied)
+	}
+
+	clock.Advance(denied.RetryAfter)
+	if retry := limiter.DecideN("a", 1); !retry.Allowed {
+		t.Errorf("Expected request after retry-after to pass: %+v", retry)
+	}
+}
+
+func TestSlidingWindowLimiter_SetLimit(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewSlidingWindowLimiter(10, 4)
+	limiter.now = clock.Now
+	defer limiter.Close()
+
+	limiter.DecideN("a", 1)
+	limiter.DecideN("a", 1)
+
+	// Lowering the limit keeps the requests already counted
+	limiter.SetLimit(2)
+	if d := limiter.DecideN("a", 1); d.Allowed || d.Limit != 2 {
+		t.Errorf("Expected rejection at the lowered limit, got %+v", d)
+	}
+
+	limiter.SetLimit(3)
+	if d := limiter.DecideN("a", 1); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("Expected the raised limit to allow one more request, got %+v", d)
+	}
+}
+
+func TestSlidingWindowLimiter_Cleanup(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewSlidingWindowLimiter(1, 2)
+	limiter.now = clock.Now
+	defer limiter.Close()
+
+	exceeded(limiter, "192.168.1.1")
+	clock.Advance(1 * time.Second)
+	exceeded(limiter, "192.168.1.2")
+
+	clock.Advance(1 * time.Second)
+	limiter.cleanup()
+
+	// Second key still has requests in the previous window
+	if len(limiter.counters) != 1 {
+		t.Fatalf("Expected 1 key after cleanup, got %d", len(limiter.counters))
+	}
+
+	clock.Advance(1 * time.Second)
+	limiter.cleanup()
+
+	if len(limiter.counters) != 0 {
+		t.Errorf("Expected all keys to be cleaned up, got %d", len(limiter.counters))
+	}
+}
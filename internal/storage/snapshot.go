@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Snapshotter is implemented by storages that can persist their state across restarts
+type Snapshotter interface {
+	// Snapshot writes the current state
+	Snapshot(w io.Writer) error
+	// Restore loads state written by Snapshot, expired entries are discarded
+	Restore(r io.Reader) error
+}
+
+// Snapshot file layout (version 1):
+//
+//	magic "RLSP" | version byte | kind byte | uvarint entry count |
+//	entries: uvarint key length, key, uvarint value count, varint values... |
+//	big endian CRC32 (IEEE) of everything before
+const (
+	snapshotMagic   = "RLSP"
+	snapshotVersion = 1
+)
+
+// Snapshot kinds and the values of their entries, a snapshot only restores into a limiter of its kind
+const (
+	snapshotSlidingLog    byte = iota + 1 // Access times in unix nanoseconds
+	snapshotTokenBucket                   // Float64 bits of the tokens, last refill in unix nanoseconds
+	snapshotGCRA                          // Theoretical arrival time in unix nanoseconds
+	snapshotSlidingWindow                 // Window index, current and previous count
+	snapshotCalendar                      // Period start in unix nanoseconds, count
+)
+
+// ErrSnapshotCorrupt is returned when a snapshot fails validation
+var ErrSnapshotCorrupt = errors.New("snapshot is corrupt")
+
+// SaveSnapshot atomically writes the storage state to path
+func SaveSnapshot(path string, s Snapshotter) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := s.Snapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot restores the storage state from path, a missing file is not an error
+func LoadSnapshot(path string, s Snapshotter) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return s.Restore(f)
+}
+
+// snapshotWriter encodes snapshot entries and appends the checksum on close
+type snapshotWriter struct {
+	buf bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func newSnapshotWriter(kind byte, entries int) *snapshotWriter {
+	sw := &snapshotWriter{}
+	sw.buf.WriteString(snapshotMagic)
+	sw.buf.WriteByte(snapshotVersion)
+	sw.buf.WriteByte(kind)
+	sw.uvarint(uint64(entries))
+	return sw
+}
+
+func (sw *snapshotWriter) uvarint(v uint64) {
+	sw.buf.Write(sw.tmp[:binary.PutUvarint(sw.tmp[:], v)])
+}
+
+func (sw *snapshotWriter) varint(v int64) {
+	sw.buf.Write(sw.tmp[:binary.PutVarint(sw.tmp[:], v)])
+}
+
+func (sw *snapshotWriter) entry(key string, values ...int64) {
+	sw.uvarint(uint64(len(key)))
+	sw.buf.WriteString(key)
+	sw.uvarint(uint64(len(values)))
+	for _, v := range values {
+		sw.varint(v)
+	}
+}
+
+func (sw *snapshotWriter) writeTo(w io.Writer) error {
+	sum := crc32.ChecksumIEEE(sw.buf.Bytes())
+	binary.Write(&sw.buf, binary.BigEndian, sum)
+	_, err := w.Write(sw.buf.Bytes())
+	return err
+}
+
+// snapshotEntry is the state of a single key
+type snapshotEntry struct {
+	key    string
+	values []int64
+}
+
+// readSnapshot validates a snapshot of the given kind and decodes all of its entries.
+// Entries of limiters with a fixed number of values must have exactly size values, 0 allows any number.
+func readSnapshot(r io.Reader, kind byte, size int) ([]snapshotEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(snapshotMagic)+2+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("%w: bad header", ErrSnapshotCorrupt)
+	}
+	if version := data[len(snapshotMagic)]; version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	body, trailer := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(trailer) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupt)
+	}
+
+	// The algorithm of a limiter may have changed between restarts
+	if got := data[len(snapshotMagic)+1]; got != kind {
+		return nil, fmt.Errorf("snapshot of kind %d cannot be restored into a limiter of kind %d", got, kind)
+	}
+
+	br := bytes.NewReader(body[len(snapshotMagic)+2:])
+	count, err := binary.ReadUvarint(br)
+	if err != nil || count > uint64(br.Len()) {
+		return nil, fmt.Errorf("%w: bad entry count", ErrSnapshotCorrupt)
+	}
+
+	entries := make([]snapshotEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		keyLen, err := binary.ReadUvarint(br)
+		if err != nil || keyLen > uint64(br.Len()) {
+			return nil, fmt.Errorf("%w: bad key length", ErrSnapshotCorrupt)
+		}
+		key := make([]byte, keyLen)
+		io.ReadFull(br, key)
+
+		n, err := binary.ReadUvarint(br)
+		if err != nil || n > uint64(br.Len()) || size > 0 && n != uint64(size) {
+			return nil, fmt.Errorf("%w: bad value count", ErrSnapshotCorrupt)
+		}
+		values := make([]int64, n)
+		for j := range values {
+			if values[j], err = binary.ReadVarint(br); err != nil {
+				return nil, fmt.Errorf("%w: bad value", ErrSnapshotCorrupt)
+			}
+		}
+
+		entries = append(entries, snapshotEntry{key: string(key), values: values})
+	}
+
+	if br.Len() != 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrSnapshotCorrupt)
+	}
+	return entries, nil
+}
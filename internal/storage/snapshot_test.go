@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiter_SnapshotRestore(t *testing.T) {
+	limiter := NewIPRateLimiter(10, 2)
+	defer limiter.Close()
+
+	limiter.CheckLimit("192.168.1.1")
+	limiter.CheckLimit("192.168.1.1")
+	limiter.CheckLimit("192.168.1.2")
+
+	// An entry that expires before the restore
+	expired := newAccessWindow(12)
+	expired.add(time.Now().Add(-time.Minute))
+	limiter.shard("192.168.1.3").accessMap["192.168.1.3"] = expired
+
+	var buf bytes.Buffer
+	if err := limiter.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	restored := NewIPRateLimiter(10, 2)
+	defer restored.Close()
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if !restored.CheckLimit("192.168.1.1") {
+		t.Error("Restored IP should still be over the limit")
+	}
+	if restored.CheckLimit("192.168.1.2") {
+		t.Error("Restored IP with remaining budget should not exceed limit")
+	}
+	if restored.window("192.168.1.3") != nil {
+		t.Error("Expired entries should not be restored")
+	}
+}
+
+func TestIPRateLimiter_RestoreKeepsAtMostLimit(t *testing.T) {
+	limiter := NewIPRateLimiter(10, 5)
+	defer limiter.Close()
+	for i := 0; i < 5; i++ {
+		limiter.CheckLimit("192.168.1.1")
+	}
+
+	var buf bytes.Buffer
+	if err := limiter.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	// The limit was lowered between restarts
+	restored := NewIPRateLimiter(10, 2)
+	defer restored.Close()
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if count := restored.window("192.168.1.1").count; count != 2 {
+		t.Errorf("Expected 2 restored accesses, got %d", count)
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "host.snap")
+
+	limiter := NewIPRateLimiter(10, 1)
+	defer limiter.Close()
+
+	// Missing snapshots are not an error
+	if err := LoadSnapshot(path, limiter); err != nil {
+		t.Fatalf("Expected missing snapshot to be ignored, got %v", err)
+	}
+
+	limiter.CheckLimit("192.168.1.1")
+	if err := SaveSnapshot(path, limiter); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	// Flip a byte inside the payload
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	data[len(snapshotMagic)+3] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+
+	corrupted := NewIPRateLimiter(10, 1)
+	defer corrupted.Close()
+	if err := LoadSnapshot(path, corrupted); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Errorf("Expected ErrSnapshotCorrupt, got %v", err)
+	}
+	if corrupted.keyCount() != 0 {
+		t.Error("Corrupt snapshot should not restore any state")
+	}
+}
+
+// snapshotStorage is an in-memory limiter that persists its state
+type snapshotStorage interface {
+	Storage
+	Snapshotter
+}
+
+func TestSnapshot_Algorithms(t *testing.T) {
+	clock := newFakeClock()
+
+	// Every storage allows 2 requests per minute
+	tests := []struct {
+		name    string
+		storage func() snapshotStorage
+	}{
+		{"token bucket", func() snapshotStorage {
+			limiter := NewTokenBucketLimiter(2, 2.0/60)
+			limiter.now = clock.Now
+			return limiter
+		}},
+		{"gcra", func() snapshotStorage {
+			limiter := NewGCRALimiter(60, 2)
+			limiter.now = clock.Now
+			return limiter
+		}},
+		{"sliding window", func() snapshotStorage {
+			limiter := NewSlidingWindowLimiter(60, 2)
+			limiter.now = clock.Now
+			return limiter
+		}},
+		{"calendar", func() snapshotStorage {
+			limiter := NewCalendarLimiter(CalendarDay, time.UTC, 2)
+			limiter.now = clock.Now
+			return limiter
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := tt.storage()
+			defer limiter.Close()
+			limiter.DecideN("a", 2)
+			limiter.DecideN("b", 1)
+
+			var buf bytes.Buffer
+			if err := limiter.Snapshot(&buf); err != nil {
+				t.Fatalf("Snapshot failed: %v", err)
+			}
+
+			restored := tt.storage()
+			defer restored.Close()
+			if err := restored.Restore(&buf); err != nil {
+				t.Fatalf("Restore failed: %v", err)
+			}
+
+			if exceeded(restored, "a") == false {
+				t.Error("Restored key should still be over the limit")
+			}
+			if exceeded(restored, "b") {
+				t.Error("Restored key with remaining budget should not exceed limit")
+			}
+			if exceeded(restored, "b") == false {
+				t.Error("Restored key should have used its budget")
+			}
+		})
+	}
+}
+
+func TestSnapshot_OtherKind(t *testing.T) {
+	limiter := NewGCRALimiter(60, 2)
+	defer limiter.Close()
+	limiter.DecideN("a", 1)
+
+	var buf bytes.Buffer
+	if err := limiter.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	// The algorithm of the limiter changed between restarts
+	restored := NewTokenBucketLimiter(2, 2.0/60)
+	defer restored.Close()
+	if err := restored.Restore(&buf); err == nil {
+		t.Error("Expected a snapshot of another algorithm to be rejected")
+	}
+	if len(restored.buckets) != 0 {
+		t.Error("Snapshot of another algorithm should not restore any state")
+	}
+}
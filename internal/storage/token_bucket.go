@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucketLimiter limits requests per key using a token bucket, which absorbs
+// short bursts up to the bucket capacity while capping the sustained rate
+type TokenBucketLimiter struct {
+	mu         sync.Mutex
+	buckets    map[string]*tokenBucket // key -> bucket
+	capacity   float64                 // Maximum number of tokens (burst size)
+	refillRate float64                 // Tokens added per second
+	now        func() time.Time        // Clock, replaceable in tests
+	*cleanupLoop
+}
+
+// tokenBucket holds the token count of a single key
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// NewTokenBucketLimiter creates a token bucket limiter with the given burst and refill rate
+func NewTokenBucketLimiter(burst int, refillRate float64) *TokenBucketLimiter {
+	limiter := &TokenBucketLimiter{
+		buckets:    make(map[string]*tokenBucket),
+		capacity:   float64(burst),
+		refillRate: refillRate,
+		now:        time.Now,
+	}
+	// Buckets are dropped once full again
+	limiter.cleanupLoop = startCleanup(cleanupInterval(limiter.durationFor(limiter.capacity)), limiter.cleanup)
+
+	return limiter
+}
+
+// refill adds tokens accumulated since the last refill, capped at capacity
+func (b *tokenBucket) refill(now time.Time, rate, capacity float64) {
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	if elapsed > 0 {
+		b.tokens += elapsed * rate
+		if b.tokens > capacity {
+			b.tokens = capacity
+		}
+		b.lastRefill = now
+	}
+}
+
+// cleanup removes full buckets, a missing bucket behaves exactly like a full one
+func (r *TokenBucketLimiter) cleanup() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	for key, bucket := range r.buckets {
+		bucket.refill(now, r.refillRate, r.capacity)
+		if bucket.tokens >= r.capacity {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// DecideN takes n tokens for the key if enough are available
+func (r *TokenBucketLimiter) DecideN(key string, n int) Decision {
+	return r.decide(key, n, true)
+}
+
+// PeekN checks whether n tokens are available for the key without taking them
+func (r *TokenBucketLimiter) PeekN(key string, n int) Decision {
+	return r.decide(key, n, false)
+}
+
+// decide checks n tokens for the key, taking them when available and take is set
+func (r *TokenBucketLimiter) decide(key string, n int, take bool) Decision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+
+	bucket, exists := r.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: r.capacity, lastRefill: now}
+		if take {
+			r.buckets[key] = bucket
+		}
+	} else {
+		bucket.refill(now, r.refillRate, r.capacity)
+	}
+
+	decision := Decision{Limit: int(r.capacity)}
+
+	tokens := bucket.tokens
+	if tokens < float64(n) {
+		decision.RetryAfter = r.durationFor(float64(n) - tokens)
+	} else {
+		tokens -= float64(n)
+		if take {
+			bucket.tokens = tokens
+		}
+		decision.Allowed = true
+	}
+
+	decision.Remaining = int(tokens)
+	decision.ResetAt = now.Add(r.durationFor(r.capacity - tokens))
+	return decision
+}
+
+// Reserve takes n tokens for the key even when they are not available yet and returns how
+// long the caller has to wait until the debt is repaid. It throttles byte streams, where
+// a token is a byte and n should not exceed the burst.
+func (r *TokenBucketLimiter) Reserve(key string, n int) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+
+	bucket, exists := r.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: r.capacity, lastRefill: now}
+		r.buckets[key] = bucket
+	} else {
+		bucket.refill(now, r.refillRate, r.capacity)
+	}
+
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return r.durationFor(-bucket.tokens)
+}
+
+// SetClock replaces the clock of the limiter, e.g. with a fake one in tests of code using it
+func (r *TokenBucketLimiter) SetClock(now func() time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.now = now
+}
+
+// durationFor returns how long it takes to refill the given number of tokens
+func (r *TokenBucketLimiter) durationFor(tokens float64) time.Duration {
+	return time.Duration(tokens / r.refillRate * float64(time.Second))
+}
+
+// Snapshot writes the buckets that are not full
+func (r *TokenBucketLimiter) Snapshot(w io.Writer) error {
+	r.mu.Lock()
+	sw := newSnapshotWriter(snapshotTokenBucket, len(r.buckets))
+	for key, bucket := range r.buckets {
+		sw.entry(key, int64(math.Float64bits(bucket.tokens)), bucket.lastRefill.UnixNano())
+	}
+	r.mu.Unlock()
+
+	return sw.writeTo(w)
+}
+
+// Restore loads buckets written by Snapshot, buckets refilled by now are dropped
+func (r *TokenBucketLimiter) Restore(rd io.Reader) error {
+	entries, err := readSnapshot(rd, snapshotTokenBucket, 2)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	for _, e := range entries {
+		bucket := &tokenBucket{tokens: math.Float64frombits(uint64(e.values[0])), lastRefill: time.Unix(0, e.values[1])}
+		// A lowered burst caps the restored tokens
+		bucket.tokens = min(bucket.tokens, r.capacity)
+		bucket.refill(now, r.refillRate, r.capacity)
+		if bucket.tokens < r.capacity {
+			r.buckets[e.key] = bucket
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for deterministic limiter tests
+type fakeClock struct {
+	t time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+// step is a single request (or clock advance) in a limiter test scenario
+type step struct {
+	advance  time.Duration
+	key      string
+	exceeded bool
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	tests := []struct {
+		name       string
+		burst      int
+		refillRate float64
+		steps      []step
+	}{
+		{
+			name:       "burst is absorbed",
+			burst:      3,
+			refillRate: 1,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+			},
+		},
+		{
+			name:       "tokens refill over time",
+			burst:      2,
+			refillRate: 1,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+				{advance: 500 * time.Millisecond, key: "a", exceeded: true},
+				{advance: 500 * time.Millisecond, key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+			},
+		},
+		{
+			name:       "refill is capped at burst",
+			burst:      2,
+			refillRate: 10,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{advance: time.Minute, key: "a", exceeded: false},
+				{key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+			},
+		},
+		{
+			name:       "sustained rate is capped",
+			burst:      1,
+			refillRate: 2,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{advance: 250 * time.Millisecond, key: "a", exceeded: true},
+				{advance: 250 * time.Millisecond, key: "a", exceeded: false},
+				{advance: 500 * time.Millisecond, key: "a", exceeded: false},
+				{key: "a", exceeded: true},
+			},
+		},
+		{
+			name:       "keys are independent",
+			burst:      1,
+			refillRate: 1,
+			steps: []step{
+				{key: "a", exceeded: false},
+				{key: "b", exceeded: false},
+				{key: "a", exceeded: true},
+				{key: "b", exceeded: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter := NewTokenBucketLimiter(tt.burst, tt.refillRate)
+			limiter.now = clock.Now
+			defer limiter.Close()
+
+			for i, s := range tt.steps {
+				clock.Advance(s.advance)
+				if got := exceeded(limiter, s.key); got != s.exceeded {
+					t.Errorf("step %d (%s): expected exceeded=%v, got %v", i, s.key, s.exceeded, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketLimiter_Decide(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewTokenBucketLimiter(2, 0.5)
+	limiter.now = clock.Now
+	defer limiter.Close()
+
+	first := limiter.DecideN("a", 1)
+	if !first.Allowed || first.Limit != 2 || first.Remaining != 1 {
+		t.Errorf("Unexpected first decision: %+v", first)
+	}
+	if want := clock.Now().Add(2 * time.Second); !first.ResetAt.Equal(want) {
+		t.Errorf("Expected reset at %v, got %v", want, first.ResetAt)
+	}
+
+	limiter.DecideN("a", 1)
+	denied := limiter.DecideN("a", 1)
+	if denied.Allowed || denied.Remaining != 0 || denied.RetryAfter != 2*time.Second {
+		t.Errorf("Unexpected denied decision: %+v", denied)
+	}
+}
+
+func TestTokenBucketLimiter_Reserve(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewTokenBucketLimiter(1000, 500) // 1000 byte burst, 500 bytes/s
+	limiter.now = clock.Now
+	defer limiter.Close()
+
+	if delay := limiter.Reserve("a", 1000); delay != 0 {
+		t.Errorf("Burst should pass without delay, got %v", delay)
+	}
+	if delay := limiter.Reserve("a", 500); delay != time.Second {
+		t.Errorf("Expected 1s delay for 500 bytes over the burst, got %v", delay)
+	}
+
+	// The debt is repaid before new bytes pass
+	clock.Advance(time.Second)
+	if delay := limiter.Reserve("a", 250); delay != 500*time.Millisecond {
+		t.Errorf("Expected 500ms delay, got %v", delay)
+	}
+
+	if delay := limiter.Reserve("b", 1000); delay != 0 {
+		t.Errorf("Other keys should have their own bucket, got %v", delay)
+	}
+}
+
+func TestTokenBucketLimiter_Cleanup(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewTokenBucketLimiter(2, 1)
+	limiter.now = clock.Now
+	defer limiter.Close()
+
+	exceeded(limiter, "192.168.1.1")
+	exceeded(limiter, "192.168.1.2")
+	exceeded(limiter, "192.168.1.2")
+
+	clock.Advance(1 * time.Second)
+	limiter.cleanup()
+
+	// First key is full again, second still has one token missing
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("Expected 1 bucket after cleanup, got %d", len(limiter.buckets))
+	}
+	if _, ok := limiter.buckets["192.168.1.2"]; !ok {
+		t.Error("Expected partially drained bucket to be kept")
+	}
+
+	clock.Advance(1 * time.Second)
+	limiter.cleanup()
+
+	if len(limiter.buckets) != 0 {
+		t.Errorf("Expected all buckets to be cleaned up, got %d", len(limiter.buckets))
+	}
+}
+
+func BenchmarkTokenBucketLimiter_CheckLimit(b *testing.B) {
+	limiter := NewTokenBucketLimiter(1000, 1000.0/60)
+	defer limiter.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		exceeded(limiter, "192.168.1.1")
+	}
+}
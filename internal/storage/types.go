@@ -1,10 +1,25 @@
 package storage
 
-import "io"
+import (
+	"io"
+	"time"
+)
+
+// Decision is the outcome of a single rate limit check
+type Decision struct {
+	Allowed    bool          // Whether the request may proceed
+	Limit      int           // Maximum number of requests in the window, -1 when unlimited
+	Remaining  int           // Requests left after this one
+	ResetAt    time.Time     // When the full limit is available again
+	RetryAfter time.Duration // How long to wait before the next request can pass, zero when allowed
+}
 
 type Storage interface {
-	// CheckLimit checks if the user has reached the limit of requests per second
-	CheckLimit(ipAddress string) bool
+	// DecideN records a request costing n units, n of at least one. Rejected requests are
+	// not recorded and consume nothing.
+	DecideN(key string, n int) Decision
+	// PeekN returns the decision DecideN would make for n units without recording anything
+	PeekN(key string, n int) Decision
 	// Close for graceful shutdown
 	io.Closer
 }
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// exceeded records a request for the key and reports whether it was rejected
+func exceeded(s Storage, key string) bool {
+	return !s.DecideN(key, 1).Allowed
+}
+
+func TestStorage_PeekN(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage func(t *testing.T) Storage // Allows 2 requests per minute
+	}{
+		{"sliding log", func(t *testing.T) Storage { return NewIPRateLimiter(60, 2) }},
+		{"token bucket", func(t *testing.T) Storage { return NewTokenBucketLimiter(2, 2.0/60) }},
+		{"gcra", func(t *testing.T) Storage { return NewGCRALimiter(60, 2) }},
+		{"sliding window", func(t *testing.T) Storage {
+			limiter := NewSlidingWindowLimiter(60, 2)
+			limiter.now = newFakeClock().Now
+			return limiter
+		}},
+		{"calendar", func(t *testing.T) Storage {
+			limiter := NewCalendarLimiter(CalendarDay, time.UTC, 2)
+			limiter.now = newFakeClock().Now
+			return limiter
+		}},
+		{"gossip", func(t *testing.T) Storage {
+			cluster, _ := newTestNode(t, "a", "secret")
+			limiter := cluster.NewGossipLimiter("host", 60, 2)
+			limiter.now = newFakeClock().Now
+			return limiter
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.storage(t)
+			defer s.Close()
+
+			// Checking never consumes quota
+			for i := 0; i < 3; i++ {
+				if d := s.PeekN("a", 1); !d.Allowed || d.Limit != 2 || d.Remaining != 1 {
+					t.Fatalf("Peek %d: unexpected decision %+v", i+1, d)
+				}
+			}
+			if d := s.PeekN("a", 3); d.Allowed || d.RetryAfter <= 0 {
+				t.Errorf("Expected a cost above the limit to be rejected, got %+v", d)
+			}
+
+			if d := s.DecideN("a", 2); !d.Allowed {
+				t.Fatalf("Expected the full quota to be available after peeking, got %+v", d)
+			}
+			if d := s.PeekN("a", 1); d.Allowed || d.RetryAfter <= 0 {
+				t.Errorf("Expected peek to report the used up quota, got %+v", d)
+			}
+			if d := s.PeekN("b", 1); !d.Allowed {
+				t.Errorf("Other keys are independent, got %+v", d)
+			}
+		})
+	}
+}